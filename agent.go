@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Headers of HMAC-signed agent requests. The signature is the hex
+// HMAC-SHA256 of the method, path, timestamp and nonce, each followed by a
+// newline, and the request body.
+const (
+	agentTimestampHeader = "X-LG-Timestamp"
+	agentNonceHeader     = "X-LG-Nonce"
+	agentSignatureHeader = "X-LG-Signature"
+	agentMaxClockSkew    = 5 * time.Minute
+	agentMaxBodySize     = 64 << 10
+	defaultAgentListen   = ":3003"
+)
+
+// AgentConfig enables agent mode: instead of the web frontend the binary
+// serves /agent/execute, running commands for a central looking glass on
+// the routers of its own config.
+type AgentConfig struct {
+	Enabled      bool   `json:"enabled"`
+	Listen       string `json:"listen"`
+	CertFile     string `json:"certFile"`     // TLS server certificate
+	KeyFile      string `json:"keyFile"`      // TLS server key
+	ClientCAFile string `json:"clientCaFile"` // require client certificates signed by this CA
+	HMACSecret   string `json:"hmacSecret"`   // require requests signed with this secret
+}
+
+type agentRequest struct {
+	Router  string `json:"router"`
+	Command string `json:"command"`
+}
+
+// signAgentRequest returns the signature of a request to path with body at
+// the given time.
+func signAgentRequest(secret, method, path, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, field := range []string{method, path, timestamp, nonce} {
+		mac.Write([]byte(field + "\n"))
+	}
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// agentSignatures remembers the signatures accepted while their timestamp
+// is within the allowed window, so a captured request cannot be replayed.
+var agentSignatures = struct {
+	sync.Mutex
+	expires map[string]time.Time
+}{expires: make(map[string]time.Time)}
+
+// rememberAgentSignature records signature until expires and reports
+// whether it was new.
+func rememberAgentSignature(signature string, expires time.Time) bool {
+	agentSignatures.Lock()
+	defer agentSignatures.Unlock()
+
+	now := time.Now()
+	for seen, expiry := range agentSignatures.expires {
+		if now.After(expiry) {
+			delete(agentSignatures.expires, seen)
+		}
+	}
+	if _, ok := agentSignatures.expires[signature]; ok {
+		return false
+	}
+	agentSignatures.expires[signature] = expires
+	return true
+}
+
+// verifyAgentSignature checks the HMAC headers of a request and rejects a
+// signature already seen.
+func verifyAgentSignature(secret string, r *http.Request, body []byte) error {
+	timestamp := r.Header.Get(agentTimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("missing or invalid timestamp")
+	}
+	signedAt := time.Unix(seconds, 0)
+	if skew := time.Since(signedAt); skew > agentMaxClockSkew || skew < -agentMaxClockSkew {
+		return errors.New("timestamp outside the allowed window")
+	}
+	nonce := r.Header.Get(agentNonceHeader)
+	if nonce == "" {
+		return errors.New("missing nonce")
+	}
+
+	signature := r.Header.Get(agentSignatureHeader)
+	expected := signAgentRequest(secret, r.Method, r.URL.Path, timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errors.New("invalid signature")
+	}
+	if !rememberAgentSignature(signature, signedAt.Add(agentMaxClockSkew)) {
+		return errors.New("replayed request")
+	}
+	return nil
+}
+
+// matchCommand finds the query whose template generates command for the
+// router, so an agent only runs commands the looking glass itself could
+// have produced from a valid request.
+func matchCommand(router RouterConfig, command string) (QueryDefinition, bool) {
+	for _, def := range queryDefinitions {
+		tmpl, ok := def.Commands[router.OSType]
+		if !ok {
+			continue
+		}
+		for _, protocol := range []string{"IPv4", "IPv6"} {
+			template := tmpl.IPv4
+			if protocol == "IPv6" && tmpl.IPv6 != "" {
+				template = tmpl.IPv6
+			}
+
+			before, after, hasAddr := strings.Cut(template, addrPlaceholder)
+			if !hasAddr {
+				if template == command {
+					return def, true
+				}
+				continue
+			}
+			if len(command) < len(before)+len(after) || !strings.HasPrefix(command, before) || !strings.HasSuffix(command, after) {
+				continue
+			}
+
+			req := ExecuteRequest{Query: def.ID, Protocol: protocol, Addr: command[len(before) : len(command)-len(after)]}
+			if validateExecuteRequest(&req) != nil {
+				continue
+			}
+			if generated, err := generateCommand(req.Query, req.Protocol, req.Addr, router); err == nil && generated == command {
+				return def, true
+			}
+		}
+	}
+	return QueryDefinition{}, false
+}
+
+// agentExecuteHandler runs a command for the central looking glass and
+// streams the usual events back.
+func agentExecuteHandler(c *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, agentMaxBodySize))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Failed to read request"})
+		return
+	}
+
+	if secret := config.Agent.HMACSecret; secret != "" {
+		if err := verifyAgentSignature(secret, c.Request, body); err != nil {
+			log.Printf("Rejected agent request from %s: %v", c.ClientIP(), err)
+			c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Authentication failed"})
+			return
+		}
+	}
+
+	var req agentRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	var routerConfig RouterConfig
+	found := false
+	for _, router := range config.Routers {
+		if router.Name == req.Router {
+			routerConfig = router
+			found = true
+			break
+		}
+	}
+	if !found {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid router selection"})
+		return
+	}
+
+	def, ok := matchCommand(routerConfig, req.Command)
+	if !ok {
+		log.Printf("Rejected agent command from %s: %q", c.ClientIP(), req.Command)
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Command not allowed"})
+		return
+	}
+
+	sendData, ok := newStreamSender(c.Writer)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Streaming unsupported"})
+		return
+	}
+	var redacted atomic.Bool
+	sendData = redactingSender(sendData, &redacted)
+
+	release, err := routerSlots.acquire(c.Request.Context(), routerConfig, func(position int) {
+		sendData(StreamResponse{Type: "queued", Router: routerConfig.Name, Position: position})
+	})
+	if err != nil {
+		sendData(StreamResponse{Type: "error", Error: err.Error()})
+		logCommand(c.ClientIP(), req.Router, req.Command, false, false)
+		return
+	}
+	defer release()
+
+	log.Printf("Agent executing command on %s: %s", routerConfig.Name, req.Command)
+
+	if def.Streaming {
+		executeCommandStreaming(routerConfig, req.Command, sendData)
+		logCommand(c.ClientIP(), req.Router, req.Command, true, redacted.Load())
+		return
+	}
+
+	sendData(StreamResponse{Type: "start", Command: req.Command})
+	output, data, err := executeCommand(routerConfig, req.Command)
+	if err != nil {
+		sendData(StreamResponse{Type: "error", Error: err.Error()})
+		logCommand(c.ClientIP(), req.Router, req.Command, false, redacted.Load())
+		return
+	}
+	for _, line := range strings.Split(output, "\n") {
+		sendData(StreamResponse{Type: "data", Data: line})
+	}
+	sendData(StreamResponse{Type: "complete", Result: data})
+	logCommand(c.ClientIP(), req.Router, req.Command, true, redacted.Load())
+}
+
+// newAgentServer builds the HTTP server of agent mode.
+func newAgentServer() (*http.Server, error) {
+	agent := config.Agent
+	if agent.HMACSecret == "" && agent.ClientCAFile == "" {
+		return nil, errors.New("agent mode needs hmacSecret or clientCaFile")
+	}
+	if agent.CertFile == "" || agent.KeyFile == "" {
+		return nil, errors.New("agent mode needs certFile and keyFile, requests are not accepted over plain HTTP")
+	}
+	listen := agent.Listen
+	if listen == "" {
+		listen = defaultAgentListen
+	}
+
+	if config.Security.SecureMode {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	r := gin.Default()
+	r.POST("/agent/execute", agentExecuteHandler)
+
+	srv := &http.Server{
+		Addr:         listen,
+		Handler:      r,
+		ReadTimeout:  time.Minute,
+		WriteTimeout: 10 * time.Minute,
+		IdleTimeout:  2 * time.Minute,
+	}
+
+	if agent.ClientCAFile != "" {
+		pem, err := os.ReadFile(agent.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", agent.ClientCAFile)
+		}
+		srv.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			ClientCAs:  pool,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+		}
+	}
+	return srv, nil
+}
+
+// runAgent serves agent mode until the process is stopped.
+func runAgent() {
+	srv, err := newAgentServer()
+	if err != nil {
+		log.Fatalf("Invalid agent configuration: %v", err)
+	}
+
+	go func() {
+		log.Printf("GoLine Looking Glass agent listening on %s", srv.Addr)
+		log.Printf("Configured routers: %d", len(config.Routers))
+
+		err := srv.ListenAndServeTLS(config.Agent.CertFile, config.Agent.KeyFile)
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Agent failed to start: %v", err)
+		}
+	}()
+
+	waitForShutdown(srv)
+}
+
+// runAgentCommand is the commandRunner for connection type "agent": the
+// command is run by a looking glass agent on a remote host, which streams
+// the output back.
+func runAgentCommand(router RouterConfig, command string, timeout time.Duration, emit func(line string)) (any, error) {
+	conn := router.Connection
+	remote := conn.RemoteRouter
+	if remote == "" {
+		remote = router.Name
+	}
+
+	if !strings.HasPrefix(conn.URL, "https://") {
+		return nil, fmt.Errorf("agent URL %q must use https", conn.URL)
+	}
+
+	body, err := json.Marshal(agentRequest{Router: remote, Command: command})
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := apiClientFor(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(conn.URL, "/")+"/agent/execute", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if conn.HMACSecret != "" {
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(agentTimestampHeader, timestamp)
+		req.Header.Set(agentNonceHeader, hex.EncodeToString(nonce))
+		req.Header.Set(agentSignatureHeader, signAgentRequest(conn.HMACSecret, req.Method, req.URL.Path,
+			timestamp, req.Header.Get(agentNonceHeader), body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("agent request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		return nil, fmt.Errorf("agent returned HTTP %d: %s", resp.StatusCode, errResp.Error)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		var event StreamResponse
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("invalid agent event: %v", err)
+		}
+		switch event.Type {
+		case "data":
+			emit(event.Data)
+		case "error":
+			return nil, errors.New(event.Error)
+		case "complete":
+			if event.Result != nil {
+				return event.Result, nil
+			}
+			return nil, nil
+		}
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("command timeout after %s", timeout)
+	}
+	return nil, errors.New("agent closed the stream before completing")
+}
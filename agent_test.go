@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func signedAgentRequest(t *testing.T, secret, method, path string, signedAt time.Time, nonce string, body []byte) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+	req.Header.Set(agentTimestampHeader, timestamp)
+	req.Header.Set(agentNonceHeader, nonce)
+	req.Header.Set(agentSignatureHeader, signAgentRequest(secret, method, path, timestamp, nonce, body))
+	return req
+}
+
+func TestVerifyAgentSignature(t *testing.T) {
+	const secret = "test-secret"
+	body := []byte(`{"router":"pop1","command":"show version"}`)
+	now := time.Now()
+
+	req := signedAgentRequest(t, secret, http.MethodPost, "/agent/execute", now, "nonce-1", body)
+	if err := verifyAgentSignature(secret, req, body); err != nil {
+		t.Fatalf("valid request rejected: %v", err)
+	}
+	if err := verifyAgentSignature(secret, req, body); err == nil || err.Error() != "replayed request" {
+		t.Errorf("replayed request: got %v", err)
+	}
+
+	// Signed for another endpoint of the agent
+	otherPath := signedAgentRequest(t, secret, http.MethodPost, "/agent/other", now, "nonce-2", body)
+	otherPath.URL.Path = "/agent/execute"
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		body []byte
+		err  string
+	}{
+		{"other path", otherPath, body, "invalid signature"},
+		{"other body", signedAgentRequest(t, secret, http.MethodPost, "/agent/execute", now, "nonce-3", body), []byte(`{"router":"pop1","command":"reload"}`), "invalid signature"},
+		{"wrong secret", signedAgentRequest(t, "other-secret", http.MethodPost, "/agent/execute", now, "nonce-4", body), body, "invalid signature"},
+		{"expired", signedAgentRequest(t, secret, http.MethodPost, "/agent/execute", now.Add(-6*time.Minute), "nonce-5", body), body, "timestamp outside the allowed window"},
+		{"from the future", signedAgentRequest(t, secret, http.MethodPost, "/agent/execute", now.Add(6*time.Minute), "nonce-6", body), body, "timestamp outside the allowed window"},
+		{"missing nonce", signedAgentRequest(t, secret, http.MethodPost, "/agent/execute", now, "", body), body, "missing nonce"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyAgentSignature(secret, tt.req, tt.body); err == nil || err.Error() != tt.err {
+				t.Errorf("got %v, want %q", err, tt.err)
+			}
+		})
+	}
+
+	// A different method with the same signature headers is not accepted
+	forged := httptest.NewRequest(http.MethodPut, "/agent/execute", bytes.NewReader(body))
+	signed := signedAgentRequest(t, secret, http.MethodPost, "/agent/execute", now, "nonce-7", body)
+	forged.Header = signed.Header
+	if err := verifyAgentSignature(secret, forged, body); err == nil || err.Error() != "invalid signature" {
+		t.Errorf("other method: got %v", err)
+	}
+}
+
+func TestAgentRunner(t *testing.T) {
+	const secret = "test-secret"
+
+	var conns atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := verifyAgentSignature(secret, r, body); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+			return
+		}
+		var req agentRequest
+		json.Unmarshal(body, &req)
+		if req.Router != "pop1-host" {
+			t.Errorf("agent asked for router %q", req.Router)
+		}
+		enc := json.NewEncoder(w)
+		enc.Encode(StreamResponse{Type: "start", Command: req.Command})
+		enc.Encode(StreamResponse{Type: "data", Data: "output of " + req.Command})
+		enc.Encode(StreamResponse{Type: "complete"})
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+	defer closeAPIClients()
+
+	router := RouterConfig{Name: "pop1", OSType: "linux", Connection: ConnectionConfig{
+		Type:         "agent",
+		URL:          server.URL + "/",
+		RemoteRouter: "pop1-host",
+		CACertFile:   writeTestCA(t, server),
+		HMACSecret:   secret,
+	}}
+
+	// The same command twice in a row must not look like a replay
+	for i := 0; i < 2; i++ {
+		var lines []string
+		_, err := runAgentCommand(router, "show version", 5*time.Second, func(line string) {
+			lines = append(lines, line)
+		})
+		if err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+		if len(lines) != 1 || lines[0] != "output of show version" {
+			t.Errorf("request %d: output = %q", i+1, lines)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("2 commands opened %d connections, want 1", n)
+	}
+
+	wrong := router
+	wrong.Connection.HMACSecret = "other-secret"
+	if _, err := runAgentCommand(wrong, "show version", 5*time.Second, func(string) {}); err == nil || !strings.Contains(err.Error(), "HTTP 401") {
+		t.Errorf("wrong secret: got %v", err)
+	}
+
+	plain := router
+	plain.Connection.URL = "http://" + strings.TrimPrefix(server.URL, "https://")
+	if _, err := runAgentCommand(plain, "show version", 5*time.Second, func(string) {}); err == nil || !strings.Contains(err.Error(), "must use https") {
+		t.Errorf("plain HTTP agent URL: got %v", err)
+	}
+}
+
+func TestNewAgentServerRequiresTLS(t *testing.T) {
+	saved := config.Agent
+	defer func() { config.Agent = saved }()
+
+	config.Agent = AgentConfig{Enabled: true, HMACSecret: "test-secret"}
+	if _, err := newAgentServer(); err == nil {
+		t.Error("HMAC-only agent without certFile started")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default control socket of BIRD 2 and 3 packages
+const defaultBirdSocket = "/run/bird/bird.ctl"
+
+// Reply codes of the BIRD control protocol we care about
+const (
+	birdCodeOK         = 0
+	birdCodeWelcome    = 1
+	birdCodeRestricted = 16
+	birdCodeProtocol   = 1002 // one line per protocol in "show protocols"
+	birdCodeFirstError = 8000 // 8xxx runtime errors, 9xxx parse errors
+)
+
+// BirdError is an error reply from the BIRD daemon.
+type BirdError struct {
+	Code    int
+	Message string
+}
+
+func (e *BirdError) Error() string {
+	return fmt.Sprintf("BIRD error %04d: %s", e.Code, e.Message)
+}
+
+type birdConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialBird connects to the control socket, reads the greeting and switches
+// the session to restricted (read-only) mode.
+func dialBird(socket string, timeout time.Duration) (*birdConn, error) {
+	conn, err := net.DialTimeout("unix", socket, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("BIRD socket connection failed: %v", err)
+	}
+
+	b := &birdConn{conn: conn, reader: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	code, err := b.readReply(nil)
+	if err == nil && code != birdCodeWelcome {
+		err = fmt.Errorf("unexpected BIRD greeting code %04d", code)
+	}
+	if err == nil {
+		code, err = b.command("restrict", nil)
+		if err == nil && code != birdCodeRestricted {
+			err = fmt.Errorf("BIRD refused restricted mode (code %04d)", code)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return b, nil
+}
+
+func (b *birdConn) Close() error {
+	return b.conn.Close()
+}
+
+// command sends one CLI command and passes each reply line to emit together
+// with its reply code. It returns the code of the final line.
+func (b *birdConn) command(cmd string, emit func(code int, text string)) (int, error) {
+	if _, err := fmt.Fprintf(b.conn, "%s\n", cmd); err != nil {
+		return 0, fmt.Errorf("BIRD write failed: %v", err)
+	}
+	return b.readReply(emit)
+}
+
+// readReply reads lines until the one that ends the reply. Lines look like
+// "1007-text" (more follow), "0000 text" (last line) or " text" (continues
+// the previous code).
+func (b *birdConn) readReply(emit func(code int, text string)) (int, error) {
+	lastCode := 0
+	for {
+		line, err := b.reader.ReadString('\n')
+		if err != nil {
+			return 0, fmt.Errorf("BIRD read failed: %v", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if len(line) >= 5 && (line[4] == ' ' || line[4] == '-') {
+			if code, err := strconv.Atoi(line[:4]); err == nil {
+				text := line[5:]
+				if code >= birdCodeFirstError {
+					return code, &BirdError{Code: code, Message: text}
+				}
+				if code != birdCodeOK && emit != nil {
+					emit(code, text)
+				}
+				if line[4] == ' ' {
+					return code, nil
+				}
+				lastCode = code
+				continue
+			}
+		}
+
+		if strings.HasPrefix(line, " ") && emit != nil {
+			emit(lastCode, line[1:])
+		}
+	}
+}
+
+// protocolForNeighbor finds the BGP protocol whose neighbor address is ip,
+// since BIRD addresses sessions by protocol name rather than by peer.
+func (b *birdConn) protocolForNeighbor(ip netip.Addr) (string, error) {
+	var current, found string
+	_, err := b.command("show protocols all", func(code int, text string) {
+		if code == birdCodeProtocol {
+			if fields := strings.Fields(text); len(fields) > 0 {
+				current = fields[0]
+			}
+			return
+		}
+		text = strings.TrimSpace(text)
+		if addr, ok := strings.CutPrefix(text, "Neighbor address:"); ok && found == "" {
+			if neighbor, err := netip.ParseAddr(strings.TrimSpace(addr)); err == nil && neighbor == ip {
+				found = current
+			}
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	if found == "" {
+		return "", fmt.Errorf("no BGP session with neighbor %s", ip)
+	}
+	return found, nil
+}
+
+// runBirdCommand is the commandRunner for connection type "bird".
+func runBirdCommand(router RouterConfig, command string, timeout time.Duration, emit func(line string)) (any, error) {
+	socket := router.Connection.Socket
+	if socket == "" {
+		socket = defaultBirdSocket
+	}
+
+	b, err := dialBird(socket, connectTimeout(router.Connection))
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+	b.conn.SetDeadline(time.Now().Add(timeout))
+
+	// "show route export <neighbor IP>" needs the protocol name instead
+	if rest, ok := strings.CutPrefix(command, "show route export "); ok {
+		fields := strings.Fields(rest)
+		if len(fields) > 0 {
+			if ip, err := netip.ParseAddr(fields[0]); err == nil {
+				name, err := b.protocolForNeighbor(ip)
+				if err != nil {
+					return nil, err
+				}
+				fields[0] = name
+				command = "show route export " + strings.Join(fields, " ")
+			}
+		}
+	}
+
+	_, err = b.command(command, func(code int, text string) {
+		emit(text)
+	})
+
+	// Runtime errors such as "Network not found" are answers, not failures
+	if birdErr, ok := err.(*BirdError); ok && birdErr.Code < 9000 {
+		emit(birdErr.Message)
+		return nil, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// birdStub is a BIRD control socket answering each command with a canned
+// reply and recording the commands it got.
+type birdStub struct {
+	mu       sync.Mutex
+	commands []string
+}
+
+func (s *birdStub) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// startBirdStub serves replies, keyed by command, on a unix socket. The
+// greeting and "restrict" are answered like BIRD does.
+func startBirdStub(t *testing.T, replies map[string]string) (RouterConfig, *birdStub) {
+	t.Helper()
+
+	// Unix socket paths are short, t.TempDir() may be too long
+	dir, err := os.MkdirTemp("", "lg-bird")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "bird.ctl")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	stub := &birdStub{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("0001 BIRD 2.15 ready.\n"))
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					cmd := scanner.Text()
+					stub.mu.Lock()
+					stub.commands = append(stub.commands, cmd)
+					stub.mu.Unlock()
+
+					reply, ok := replies[cmd]
+					switch {
+					case cmd == "restrict":
+						reply = "0016 Access restricted\n"
+					case !ok:
+						reply = "9001 syntax error, unexpected CF_SYM_UNDEFINED\n"
+					}
+					conn.Write([]byte(reply))
+				}
+			}()
+		}
+	}()
+
+	router := RouterConfig{
+		Name:       "bird1",
+		OSType:     "bird",
+		Connection: ConnectionConfig{Type: "bird", Socket: socket, Timeout: 2000},
+	}
+	return router, stub
+}
+
+func runBird(t *testing.T, router RouterConfig, command string) ([]string, error) {
+	t.Helper()
+	var lines []string
+	_, err := runBirdCommand(router, command, 2*time.Second, func(line string) {
+		lines = append(lines, line)
+	})
+	return lines, err
+}
+
+const birdProtocols = "2002-Name       Proto      Table      State  Since         Info\n" +
+	"1002-device1    Device     ---        up     2026-10-01    \n" +
+	"1002-upstream1  BGP        ---        up     2026-10-01    Established   \n" +
+	"1006-  BGP state:          Established\n" +
+	"      Neighbor address: 192.0.2.1\n" +
+	"      Neighbor AS:      64500\n" +
+	"1002-customer1  BGP        ---        up     2026-10-01    Established   \n" +
+	"1006-  BGP state:          Established\n" +
+	"      Neighbor address: 2001:db8::2\n" +
+	"      Neighbor AS:      64501\n" +
+	"0000 \n"
+
+func TestBirdReplyCodes(t *testing.T) {
+	router, _ := startBirdStub(t, map[string]string{
+		"show route for 198.51.100.0/24 all": "1007-198.51.100.0/24      unicast [upstream1 2026-10-01] * (100) [AS64500i]\n" +
+			" \tvia 192.0.2.1 on eth0\n" +
+			"1008-\tType: BGP univ\n" +
+			" \tBGP.as_path: 64500\n" +
+			"0000 \n",
+		"show route for 203.0.113.1": "8001 Network not found\n",
+		"show status":                "1000-BIRD 2.15\n1011-Router ID is 192.0.2.254\n0013 Daemon is up and running\n",
+	})
+
+	tests := []struct {
+		name    string
+		command string
+		want    []string
+		err     string
+	}{
+		{
+			// "0000" ends the reply without text of its own, continuation
+			// lines keep the code of the line before
+			name:    "continuation lines",
+			command: "show route for 198.51.100.0/24 all",
+			want: []string{
+				"198.51.100.0/24      unicast [upstream1 2026-10-01] * (100) [AS64500i]",
+				"\tvia 192.0.2.1 on eth0",
+				"\tType: BGP univ",
+				"\tBGP.as_path: 64500",
+			},
+		},
+		{
+			// The last line can carry text with a non-zero code
+			name:    "final line with text",
+			command: "show status",
+			want:    []string{"BIRD 2.15", "Router ID is 192.0.2.254", "Daemon is up and running"},
+		},
+		{
+			// Runtime errors are shown as the answer
+			name:    "8xxx",
+			command: "show route for 203.0.113.1",
+			want:    []string{"Network not found"},
+		},
+		{
+			name:    "9xxx",
+			command: "show route for bogus",
+			err:     "BIRD error 9001: syntax error, unexpected CF_SYM_UNDEFINED",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines, err := runBird(t, router, tt.command)
+			if tt.err != "" {
+				var birdErr *BirdError
+				if !errors.As(err, &birdErr) || err.Error() != tt.err {
+					t.Fatalf("got %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(lines, tt.want) {
+				t.Errorf("lines = %q, want %q", lines, tt.want)
+			}
+		})
+	}
+}
+
+func TestBirdGreeting(t *testing.T) {
+	router, _ := startBirdStub(t, nil)
+	listener, err := net.Listen("unix", router.Connection.Socket+".other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Write([]byte("0016 Access restricted\n"))
+		}
+	}()
+
+	if _, err := dialBird(router.Connection.Socket+".other", time.Second); err == nil || !strings.Contains(err.Error(), "greeting") {
+		t.Errorf("got %v, want a greeting error", err)
+	}
+	if _, err := dialBird(router.Connection.Socket+".missing", time.Second); err == nil {
+		t.Error("missing socket: want an error")
+	}
+}
+
+func TestBirdNeighborProtocol(t *testing.T) {
+	router, stub := startBirdStub(t, map[string]string{
+		"show protocols all":                  birdProtocols,
+		"show route export customer1":         "1007-198.51.100.0/24      unicast [static1 2026-10-01] * (200)\n0000 \n",
+		"show route export upstream1 primary": "0000 \n",
+	})
+
+	lines, err := runBird(t, router, "show route export 2001:db8::2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "198.51.100.0/24") {
+		t.Errorf("lines = %q", lines)
+	}
+	// Further arguments stay after the protocol name
+	if _, err := runBird(t, router, "show route export 192.0.2.1 primary"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"restrict", "show protocols all", "show route export customer1",
+		"restrict", "show protocols all", "show route export upstream1 primary",
+	}
+	if got := stub.received(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+
+	if _, err := runBird(t, router, "show route export 192.0.2.99"); err == nil || !strings.Contains(err.Error(), "no BGP session with neighbor 192.0.2.99") {
+		t.Errorf("unknown neighbor: got %v", err)
+	}
+}
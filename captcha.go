@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Default siteverify endpoints; recaptcha.verifyUrl overrides them (e.g. to
+// point at a local stub in tests)
+var captchaVerifyURLs = map[string]string{
+	"recaptcha": "https://www.google.com/recaptcha/api/siteverify",
+	"hcaptcha":  "https://api.hcaptcha.com/siteverify",
+	"turnstile": "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+}
+
+var captchaHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// Common subset of the reCAPTCHA, hCaptcha and Turnstile siteverify replies
+type captchaVerifyResponse struct {
+	Success    bool     `json:"success"`
+	Score      *float64 `json:"score"`
+	Action     *string  `json:"action"`
+	Hostname   string   `json:"hostname"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+// CaptchaInfo is what /api/captcha exposes to the frontend to render the
+// widget.
+type CaptchaInfo struct {
+	Enabled  bool   `json:"enabled"`
+	Provider string `json:"provider,omitempty"`
+	SiteKey  string `json:"siteKey,omitempty"`
+	Action   string `json:"action,omitempty"`
+}
+
+func captchaProvider() string {
+	if config.Recaptcha.Provider == "" {
+		return "recaptcha"
+	}
+	return config.Recaptcha.Provider
+}
+
+// API handler
+func getCaptchaHandler(c *gin.Context) {
+	captcha := config.Recaptcha
+	if !captcha.Enabled {
+		c.JSON(http.StatusOK, CaptchaInfo{})
+		return
+	}
+	c.JSON(http.StatusOK, CaptchaInfo{
+		Enabled:  true,
+		Provider: captchaProvider(),
+		SiteKey:  captcha.SiteKey,
+		Action:   captcha.Action,
+	})
+}
+
+// verifyRecaptcha checks a client token against the configured provider.
+// A false result with a nil error means the token was rejected.
+func verifyRecaptcha(token, remoteIP string) (bool, error) {
+	captcha := config.Recaptcha
+	if !captcha.Enabled {
+		return true, nil
+	}
+	if token == "" {
+		return false, nil
+	}
+
+	provider := captchaProvider()
+	verifyURL := captcha.VerifyURL
+	if verifyURL == "" {
+		verifyURL = captchaVerifyURLs[provider]
+	}
+	if verifyURL == "" {
+		return false, fmt.Errorf("unknown captcha provider %q", provider)
+	}
+
+	form := url.Values{
+		"secret":   {captcha.SecretKey},
+		"response": {token},
+	}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+
+	resp, err := captchaHTTPClient.PostForm(verifyURL, form)
+	if err != nil {
+		return false, fmt.Errorf("captcha verification request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("captcha verification returned HTTP %d", resp.StatusCode)
+	}
+
+	var result captchaVerifyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, fmt.Errorf("invalid captcha verification response: %v", err)
+	}
+
+	if !result.Success {
+		log.Printf("Captcha rejected for %s: %s", remoteIP, strings.Join(result.ErrorCodes, ", "))
+		return false, nil
+	}
+
+	// Score is only returned by reCAPTCHA v3 and hCaptcha Enterprise
+	if captcha.MinScore > 0 && result.Score != nil && *result.Score < captcha.MinScore {
+		log.Printf("Captcha score too low for %s: %.2f < %.2f", remoteIP, *result.Score, captcha.MinScore)
+		return false, nil
+	}
+
+	// Only reCAPTCHA v3 and Turnstile report the action of the token;
+	// reCAPTCHA v2 and hCaptcha replies have none
+	checkAction := provider == "recaptcha" || provider == "turnstile"
+	if checkAction && captcha.Action != "" && result.Action != nil && *result.Action != captcha.Action {
+		log.Printf("Captcha action mismatch for %s: got %q, want %q", remoteIP, *result.Action, captcha.Action)
+		return false, nil
+	}
+
+	return true, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// startCaptchaStub serves a siteverify endpoint answering with reply and
+// checking the form fields every provider is sent.
+func startCaptchaStub(t *testing.T, status int, reply string) string {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("siteverify called with %s", r.Method)
+		}
+		if got := r.PostFormValue("secret"); got != "test-secret" {
+			t.Errorf("secret = %q", got)
+		}
+		if got := r.PostFormValue("response"); got != "test-token" {
+			t.Errorf("response = %q", got)
+		}
+		if got := r.PostFormValue("remoteip"); got != "192.0.2.1" {
+			t.Errorf("remoteip = %q", got)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(reply))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestVerifyRecaptcha(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider string
+		minScore float64
+		action   string
+		status   int
+		reply    string
+		want     bool
+		err      bool
+	}{
+		{"success", "recaptcha", 0, "", 200, `{"success": true}`, true, false},
+		{"rejected", "recaptcha", 0, "", 200, `{"success": false, "error-codes": ["invalid-input-response"]}`, false, false},
+		{"v3 score ok", "recaptcha", 0.5, "execute", 200, `{"success": true, "score": 0.9, "action": "execute"}`, true, false},
+		{"v3 score too low", "recaptcha", 0.5, "execute", 200, `{"success": true, "score": 0.1, "action": "execute"}`, false, false},
+		{"v3 action mismatch", "recaptcha", 0.5, "execute", 200, `{"success": true, "score": 0.9, "action": "login"}`, false, false},
+		{"v2 has no action", "recaptcha", 0.5, "execute", 200, `{"success": true, "hostname": "lg.example.com"}`, true, false},
+		{"hcaptcha has no action", "hcaptcha", 0, "execute", 200, `{"success": true}`, true, false},
+		{"hcaptcha action ignored", "hcaptcha", 0, "execute", 200, `{"success": true, "action": "other"}`, true, false},
+		{"turnstile action ok", "turnstile", 0, "execute", 200, `{"success": true, "action": "execute"}`, true, false},
+		{"turnstile action mismatch", "turnstile", 0, "execute", 200, `{"success": true, "action": "login"}`, false, false},
+		{"http error", "turnstile", 0, "", 500, `{}`, false, true},
+		{"invalid reply", "hcaptcha", 0, "", 200, `not json`, false, true},
+	}
+
+	saved := config.Recaptcha
+	defer func() { config.Recaptcha = saved }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Recaptcha = RecaptchaConfig{
+				Enabled:   true,
+				Provider:  tt.provider,
+				SecretKey: "test-secret",
+				VerifyURL: startCaptchaStub(t, tt.status, tt.reply),
+				MinScore:  tt.minScore,
+				Action:    tt.action,
+			}
+
+			valid, err := verifyRecaptcha("test-token", "192.0.2.1")
+			if (err != nil) != tt.err {
+				t.Fatalf("verifyRecaptcha error = %v, want error: %t", err, tt.err)
+			}
+			if valid != tt.want {
+				t.Errorf("verifyRecaptcha = %t, want %t", valid, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyRecaptchaWithoutToken(t *testing.T) {
+	saved := config.Recaptcha
+	defer func() { config.Recaptcha = saved }()
+
+	config.Recaptcha = RecaptchaConfig{Enabled: false}
+	if valid, err := verifyRecaptcha("", "192.0.2.1"); !valid || err != nil {
+		t.Errorf("disabled captcha: got %t, %v", valid, err)
+	}
+
+	// Nothing listens there: an empty token must not reach the provider
+	config.Recaptcha = RecaptchaConfig{Enabled: true, VerifyURL: "http://127.0.0.1:1/"}
+	if valid, err := verifyRecaptcha("", "192.0.2.1"); valid || err != nil {
+		t.Errorf("empty token: got %t, %v", valid, err)
+	}
+}
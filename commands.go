@@ -0,0 +1,339 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Placeholder replaced by the validated address in command templates
+const addrPlaceholder = "{addr}"
+
+// QueryDefinition describes one query offered by the looking glass and the
+// command used for it on every supported router OS.
+type QueryDefinition struct {
+	ID              string                     `json:"id"`
+	Label           string                     `json:"label"`
+	Icon            string                     `json:"icon,omitempty"`
+	AddressRequired bool                       `json:"addressRequired"`
+	Argument        string                     `json:"argument,omitempty"` // address, prefix or hostname
+	Streaming       bool                       `json:"streaming"`
+	Placeholder     string                     `json:"placeholder,omitempty"`
+	Description     string                     `json:"description,omitempty"`
+	Commands        map[string]CommandTemplate `json:"commands"` // keyed by router osType
+}
+
+// CommandTemplate holds the per-family command. An empty IPv6 template
+// means the IPv4 one works for both.
+type CommandTemplate struct {
+	IPv4 string `json:"ipv4"`
+	IPv6 string `json:"ipv6,omitempty"`
+}
+
+type queriesFile struct {
+	Queries []QueryDefinition `json:"queries"`
+}
+
+// QueryInfo is what /api/queries exposes to the frontend.
+type QueryInfo struct {
+	ID              string   `json:"id"`
+	Label           string   `json:"label"`
+	Icon            string   `json:"icon,omitempty"`
+	AddressRequired bool     `json:"addressRequired"`
+	Argument        string   `json:"argument,omitempty"`
+	Streaming       bool     `json:"streaming"`
+	Placeholder     string   `json:"placeholder,omitempty"`
+	Description     string   `json:"description,omitempty"`
+	OSTypes         []string `json:"osTypes"`
+}
+
+// Built-in definitions, used unless commandsFile is configured. The file is
+// also the template to start a commandsFile from, so it is the only place
+// the default command templates are written down.
+//
+//go:embed config/commands.example.json
+var defaultQueriesFile []byte
+
+var defaultQueryDefinitions = func() []QueryDefinition {
+	defs, err := parseQueries(defaultQueriesFile)
+	if err != nil {
+		panic("built-in query definitions: " + err.Error())
+	}
+	return defs
+}()
+
+// OSProfile describes how output paging is avoided on a router OS.
+// PagerSuffix is appended to show commands run over an exec channel;
+// DisablePaging is sent first on sessions with a terminal attached, where
+// the pager would otherwise stop at every screen.
+type OSProfile struct {
+	PagerSuffix   string
+	DisablePaging []string
+
+	// Wraps the command for OSes whose SSH login lands in a Unix shell
+	// rather than the routing CLI; %s is replaced by the quoted command, or
+	// by each word quoted separately with ExecSplitArgs
+	ExecFormat    string
+	ExecSplitArgs bool
+
+	// ShellOnly OSes refuse SSH exec requests: commands are typed into an
+	// interactive session after DisablePaging, and lines matching Prompt
+	// (the prompt with the echoed input) are dropped from the output.
+	// Telnet sessions also use Prompt to tell when a command has finished.
+	ShellOnly bool
+	Prompt    *regexp.Regexp
+
+	// Default output filters, after those of the config
+	OutputFilters []OutputFilter
+}
+
+var osProfiles = map[string]OSProfile{
+	// "<HUAWEI>", "[~HUAWEI]"
+	"huawei": {
+		PagerSuffix:   " | no-more",
+		DisablePaging: []string{"screen-length 0 temporary"},
+		Prompt:        regexp.MustCompile(`^[<\[][~*]?[\w.:/-]+[>\]]`),
+		// Login notices VRP prints on every session
+		OutputFilters: dropLines(
+			`^Info: The max number of VTY users`,
+			`and the number of current VTY users on line is`,
+			`^The current login time is`,
+			`^The last login time is`,
+			`through SSH\.?$`,
+		),
+	},
+	// "user@router>"
+	"junos": {
+		PagerSuffix:   " | no-more",
+		DisablePaging: []string{"set cli screen-length 0"},
+		Prompt:        regexp.MustCompile(`^[\w.-]+@[\w.-]+[>#]`),
+		// Routing engine banner of dual-RE systems
+		OutputFilters: dropLines(`^\{(master|backup|linecard)(:\d+)?\}$`),
+	},
+	// "switch#"
+	"nxos": {
+		PagerSuffix:   " | no-more",
+		DisablePaging: []string{"terminal length 0"},
+		Prompt:        regexp.MustCompile(`^[\w.-]+(\([\w-]+\))?[>#]`),
+	},
+	// IOS-XR and IOS-XE don't page exec channel output and have no
+	// per-command equivalent of "| no-more". "RP/0/RSP0/CPU0:router#"
+	// and "router#"
+	"iosxr": {
+		DisablePaging: []string{"terminal length 0", "terminal width 0"},
+		Prompt:        regexp.MustCompile(`^(RP/\d+/[\w/]+:)?[\w.-]+(\([\w-]+\))?#`),
+		// Timestamp printed before the output of every command
+		OutputFilters: dropLines(`^(Mon|Tue|Wed|Thu|Fri|Sat|Sun) [A-Z][a-z]{2} +\d+ \d+:\d+:\d+\.\d+ \S+$`),
+	},
+	"iosxe": {
+		DisablePaging: []string{"terminal length 0", "terminal width 0"},
+		Prompt:        regexp.MustCompile(`^[\w.-]+(\([\w-]+\))?[>#]`),
+	},
+	"frr": {ExecFormat: "vtysh -c %s"},
+	// bgpctl takes the command as separate arguments
+	"openbgpd": {ExecFormat: "bgpctl -j %s", ExecSplitArgs: true},
+	// Nokia SR OS, classic CLI ("A:pe1#") and MD-CLI ("[/]" + "A:admin@pe1#")
+	"sros": {
+		DisablePaging: []string{"environment no more"},
+		ShellOnly:     true,
+		Prompt:        regexp.MustCompile(`^\*?[A-D]:[^#>\s]+[#>]`),
+	},
+	"sros-md": {
+		DisablePaging: []string{"environment more false"},
+		ShellOnly:     true,
+		Prompt:        regexp.MustCompile(`^(\[[^\]]*\]$|[*!]?[A-D]:\S+@[^#\s]+#)`),
+	},
+}
+
+// withPagerSuffix appends the OS pager suffix to show commands. Ping and
+// traceroute are left alone since they never page and would reject it.
+func withPagerSuffix(router RouterConfig, command string) string {
+	suffix := osProfiles[router.OSType].PagerSuffix
+	if suffix == "" || strings.Contains(command, "ping") || strings.Contains(command, "trace") {
+		return command
+	}
+	return command + suffix
+}
+
+// withExecFormat wraps the command according to the OS ExecFormat, quoting
+// it for a POSIX shell.
+func withExecFormat(router RouterConfig, command string) string {
+	profile := osProfiles[router.OSType]
+	if profile.ExecFormat == "" {
+		return command
+	}
+
+	quote := func(s string) string {
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	}
+	if !profile.ExecSplitArgs {
+		return fmt.Sprintf(profile.ExecFormat, quote(command))
+	}
+	words := strings.Fields(command)
+	for i, word := range words {
+		words[i] = quote(word)
+	}
+	return fmt.Sprintf(profile.ExecFormat, strings.Join(words, " "))
+}
+
+// Active query definitions, replaced by loadQueries at startup
+var queryDefinitions = defaultQueryDefinitions
+
+// loadQueries reads the command definitions from commandsFile, if set, and
+// validates them. Startup fails on any invalid definition.
+func loadQueries() error {
+	defs := defaultQueryDefinitions
+
+	if config.CommandsFile != "" {
+		data, err := os.ReadFile(config.CommandsFile)
+		if err != nil {
+			return fmt.Errorf("failed to read commands file: %v", err)
+		}
+		if defs, err = parseQueries(data); err != nil {
+			return fmt.Errorf("failed to parse commands file %s: %v", config.CommandsFile, err)
+		}
+	}
+
+	if err := validateQueryDefinitions(defs); err != nil {
+		return err
+	}
+	queryDefinitions = defs
+
+	for _, router := range config.Routers {
+		if len(supportedQueries(router)) == 0 {
+			log.Printf("Warning: no commands defined for router %s (osType %q)", router.Name, router.OSType)
+		}
+	}
+	return nil
+}
+
+func parseQueries(data []byte) ([]QueryDefinition, error) {
+	var file queriesFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	return file.Queries, nil
+}
+
+func validateQueryDefinitions(defs []QueryDefinition) error {
+	if len(defs) == 0 {
+		return fmt.Errorf("no query definitions")
+	}
+
+	seen := make(map[string]bool)
+	for i, def := range defs {
+		if def.ID == "" {
+			return fmt.Errorf("query #%d: missing id", i+1)
+		}
+		if seen[def.ID] {
+			return fmt.Errorf("query %q: duplicate id", def.ID)
+		}
+		seen[def.ID] = true
+
+		if def.Label == "" {
+			return fmt.Errorf("query %q: missing label", def.ID)
+		}
+		if def.AddressRequired {
+			switch def.Argument {
+			case argAddress, argPrefix, argHostname:
+			default:
+				return fmt.Errorf("query %q: argument must be address, prefix or hostname", def.ID)
+			}
+		} else if def.Argument != "" {
+			return fmt.Errorf("query %q: argument set but addressRequired is false", def.ID)
+		}
+		if len(def.Commands) == 0 {
+			return fmt.Errorf("query %q: no commands", def.ID)
+		}
+
+		for osType, tmpl := range def.Commands {
+			if tmpl.IPv4 == "" {
+				return fmt.Errorf("query %q, os %s: missing ipv4 template", def.ID, osType)
+			}
+			for _, t := range []string{tmpl.IPv4, tmpl.IPv6} {
+				if t == "" {
+					continue
+				}
+				if strings.ContainsAny(t, "\r\n") {
+					return fmt.Errorf("query %q, os %s: template must be a single line", def.ID, osType)
+				}
+				if hasAddr := strings.Contains(t, addrPlaceholder); hasAddr != def.AddressRequired {
+					return fmt.Errorf("query %q, os %s: %s placeholder must be used exactly when addressRequired is set", def.ID, osType, addrPlaceholder)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func findQuery(id string) (QueryDefinition, bool) {
+	for _, def := range queryDefinitions {
+		if def.ID == id {
+			return def, true
+		}
+	}
+	return QueryDefinition{}, false
+}
+
+// supportedQueries lists the query ids the router has a command for.
+func supportedQueries(router RouterConfig) []string {
+	var ids []string
+	for _, def := range queryDefinitions {
+		if _, ok := def.Commands[router.OSType]; ok {
+			ids = append(ids, def.ID)
+		}
+	}
+	return ids
+}
+
+// generateCommand renders the command template of the query for the router
+// OS. addr must already have been canonicalized by validateExecuteRequest.
+func generateCommand(query, protocol, addr string, routerConfig RouterConfig) (string, error) {
+	def, ok := findQuery(query)
+	if !ok {
+		return "", fmt.Errorf("unsupported query type or router OS")
+	}
+	tmpl, ok := def.Commands[routerConfig.OSType]
+	if !ok {
+		return "", fmt.Errorf("unsupported query type or router OS")
+	}
+
+	command := tmpl.IPv4
+	if protocol == "IPv6" && tmpl.IPv6 != "" {
+		command = tmpl.IPv6
+	}
+	return strings.ReplaceAll(command, addrPlaceholder, addr), nil
+}
+
+// API handler
+func getQueriesHandler(c *gin.Context) {
+	queries := make([]QueryInfo, len(queryDefinitions))
+	for i, def := range queryDefinitions {
+		osTypes := make([]string, 0, len(def.Commands))
+		for osType := range def.Commands {
+			osTypes = append(osTypes, osType)
+		}
+		sort.Strings(osTypes)
+
+		queries[i] = QueryInfo{
+			ID:              def.ID,
+			Label:           def.Label,
+			Icon:            def.Icon,
+			AddressRequired: def.AddressRequired,
+			Argument:        def.Argument,
+			Streaming:       def.Streaming,
+			Placeholder:     def.Placeholder,
+			Description:     def.Description,
+			OSTypes:         osTypes,
+		}
+	}
+	c.JSON(http.StatusOK, queries)
+}
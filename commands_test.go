@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestDefaultQueryDefinitions(t *testing.T) {
+	if err := validateQueryDefinitions(defaultQueryDefinitions); err != nil {
+		t.Fatalf("config/commands.example.json: %v", err)
+	}
+
+	// Queries printing their output as they go are streamed
+	for _, id := range []string{"ping", "trace"} {
+		if def, ok := findQuery(id); !ok || !def.Streaming {
+			t.Errorf("query %q is not streaming", id)
+		}
+	}
+	// mtr --json only prints its report at the end
+	if def, ok := findQuery("mtr"); !ok || def.Streaming {
+		t.Error("query \"mtr\" is streaming")
+	}
+}
+
+func TestGenerateCommand(t *testing.T) {
+	tests := []struct {
+		query    string
+		protocol string
+		addr     string
+		osType   string
+		want     string
+	}{
+		{"bgp", "IPv4", "192.0.2.0/24", "huawei", "display bgp routing-table 192.0.2.0/24"},
+		{"bgp", "IPv6", "2001:db8::/32", "huawei", "display bgp ipv6 routing-table 2001:db8::/32"},
+		{"bgp", "IPv6", "2001:db8::/32", "junos", "show route 2001:db8::/32"},
+		{"advertised-routes", "IPv4", "192.0.2.1", "gobgp", "neighbor 192.0.2.1 adj-out -a ipv4"},
+		{"summary", "IPv4", "", "bird", "show protocols"},
+		{"ping", "IPv6", "example.com", "linux", "ping -6 -c 5 example.com"},
+	}
+
+	for _, tt := range tests {
+		got, err := generateCommand(tt.query, tt.protocol, tt.addr, RouterConfig{OSType: tt.osType})
+		if err != nil {
+			t.Errorf("%s on %s: %v", tt.query, tt.osType, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s on %s = %q, want %q", tt.query, tt.osType, got, tt.want)
+		}
+	}
+
+	if _, err := generateCommand("mtr", "IPv4", "192.0.2.1", RouterConfig{OSType: "huawei"}); err == nil {
+		t.Error("mtr on huawei: want an error for a missing template")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Used when a router sets maxConcurrent but no queueTimeoutMs
+const defaultQueueTimeout = 60 * time.Second
+
+var errQueueTimeout = errors.New("router is busy, please try again later")
+
+// routerSlots limits how many commands run at the same time on each router.
+var routerSlots = &slotManager{routers: make(map[string]*routerSemaphore)}
+
+type slotManager struct {
+	mu      sync.Mutex
+	routers map[string]*routerSemaphore
+}
+
+// routerSemaphore is a FIFO semaphore: slots are handed to waiters in arrival
+// order so queue positions reported to clients are accurate.
+type routerSemaphore struct {
+	mu      sync.Mutex
+	max     int
+	active  int
+	waiters []*slotWaiter
+}
+
+type slotWaiter struct {
+	ready chan struct{} // closed when the slot is handed over
+	moved chan struct{} // signalled when the queue advances
+}
+
+// acquire waits for a free slot on the router. onQueued, if not nil, is
+// called with the 1-based queue position whenever the request has to wait
+// and each time it moves up. Routers without maxConcurrent never block.
+func (m *slotManager) acquire(ctx context.Context, router RouterConfig, onQueued func(position int)) (func(), error) {
+	if router.MaxConcurrent <= 0 {
+		return func() {}, nil
+	}
+
+	sem := m.get(router)
+
+	timeout := defaultQueueTimeout
+	if router.QueueTimeoutMs > 0 {
+		timeout = time.Duration(router.QueueTimeoutMs) * time.Millisecond
+	}
+
+	sem.mu.Lock()
+	if sem.active < sem.max && len(sem.waiters) == 0 {
+		sem.active++
+		sem.mu.Unlock()
+		return sem.release, nil
+	}
+
+	waiter := &slotWaiter{ready: make(chan struct{}), moved: make(chan struct{}, 1)}
+	sem.waiters = append(sem.waiters, waiter)
+	position := len(sem.waiters)
+	sem.mu.Unlock()
+
+	if onQueued != nil {
+		onQueued(position)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-waiter.ready:
+			return sem.release, nil
+
+		case <-waiter.moved:
+			sem.mu.Lock()
+			newPosition := sem.position(waiter)
+			sem.mu.Unlock()
+			if newPosition > 0 && newPosition != position {
+				position = newPosition
+				if onQueued != nil {
+					onQueued(position)
+				}
+			}
+
+		case <-timer.C:
+			if sem.leave(waiter) {
+				return nil, errQueueTimeout
+			}
+			// The slot was handed over while we were timing out
+			return sem.release, nil
+
+		case <-ctx.Done():
+			if sem.leave(waiter) {
+				return nil, ctx.Err()
+			}
+			sem.release()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (m *slotManager) get(router RouterConfig) *routerSemaphore {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sem, ok := m.routers[router.Name]
+	if !ok {
+		sem = &routerSemaphore{max: router.MaxConcurrent}
+		m.routers[router.Name] = sem
+	}
+	return sem
+}
+
+// release frees a slot, handing it straight to the first waiter if any.
+func (s *routerSemaphore) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.waiters) == 0 {
+		s.active--
+		return
+	}
+
+	next := s.waiters[0]
+	s.waiters = s.waiters[1:]
+	close(next.ready)
+	s.notifyMoved()
+}
+
+// leave removes a waiter that gave up. It returns false if the waiter had
+// already been given a slot, which the caller then owns.
+func (s *routerSemaphore) leave(waiter *slotWaiter) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, w := range s.waiters {
+		if w == waiter {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			s.notifyMoved()
+			return true
+		}
+	}
+	return false
+}
+
+func (s *routerSemaphore) position(waiter *slotWaiter) int {
+	for i, w := range s.waiters {
+		if w == waiter {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (s *routerSemaphore) notifyMoved() {
+	for _, w := range s.waiters {
+		select {
+		case w.moved <- struct{}{}:
+		default:
+		}
+	}
+}
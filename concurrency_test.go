@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// queueRecorder collects the queue positions reported to one request.
+type queueRecorder struct {
+	mu        sync.Mutex
+	positions []int
+	queued    chan struct{}
+}
+
+func newQueueRecorder() *queueRecorder {
+	return &queueRecorder{queued: make(chan struct{}, 16)}
+}
+
+func (q *queueRecorder) onQueued(position int) {
+	q.mu.Lock()
+	q.positions = append(q.positions, position)
+	q.mu.Unlock()
+	q.queued <- struct{}{}
+}
+
+func (q *queueRecorder) reported() []int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]int(nil), q.positions...)
+}
+
+func waitQueued(t *testing.T, q *queueRecorder) {
+	t.Helper()
+	select {
+	case <-q.queued:
+	case <-time.After(2 * time.Second):
+		t.Fatal("request was not queued")
+	}
+}
+
+func TestRouterSlotsFIFO(t *testing.T) {
+	slots := &slotManager{routers: make(map[string]*routerSemaphore)}
+	router := RouterConfig{Name: "r1", MaxConcurrent: 1}
+
+	release, err := slots.acquire(context.Background(), router, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const waiters = 3
+	order := make(chan int, waiters)
+	recorders := make([]*queueRecorder, waiters)
+	for i := range recorders {
+		recorders[i] = newQueueRecorder()
+		go func(i int) {
+			release, err := slots.acquire(context.Background(), router, recorders[i].onQueued)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			order <- i
+			release()
+		}(i)
+		// Queue them one after the other
+		waitQueued(t, recorders[i])
+	}
+
+	release()
+	for want := 0; want < waiters; want++ {
+		select {
+		case got := <-order:
+			if got != want {
+				t.Fatalf("request %d got the slot, want %d", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("queue stalled")
+		}
+	}
+
+	// Each request saw its place and then moved up as the ones ahead ran
+	for i, recorder := range recorders {
+		positions := recorder.reported()
+		if len(positions) == 0 || positions[0] != i+1 {
+			t.Errorf("request %d positions = %v, want to start at %d", i, positions, i+1)
+		}
+		for j := 1; j < len(positions); j++ {
+			if positions[j] >= positions[j-1] {
+				t.Errorf("request %d positions = %v, want decreasing", i, positions)
+			}
+		}
+	}
+}
+
+func TestRouterSlotsTimeout(t *testing.T) {
+	slots := &slotManager{routers: make(map[string]*routerSemaphore)}
+	router := RouterConfig{Name: "r1", MaxConcurrent: 1, QueueTimeoutMs: 100}
+
+	release, err := slots.acquire(context.Background(), router, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	start := time.Now()
+	_, err = slots.acquire(context.Background(), router, nil)
+	if !errors.Is(err, errQueueTimeout) {
+		t.Fatalf("got %v, want errQueueTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("timed out after %s, want about 100ms", elapsed)
+	}
+	if n := len(slots.get(router).waiters); n != 0 {
+		t.Errorf("%d waiters left in the queue", n)
+	}
+}
+
+func TestRouterSlotsClientGone(t *testing.T) {
+	slots := &slotManager{routers: make(map[string]*routerSemaphore)}
+	router := RouterConfig{Name: "r1", MaxConcurrent: 1}
+
+	release, err := slots.acquire(context.Background(), router, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first waiter disconnects, the one behind it moves up
+	ctx, cancel := context.WithCancel(context.Background())
+	first, second := newQueueRecorder(), newQueueRecorder()
+	gone := make(chan error, 1)
+	go func() {
+		_, err := slots.acquire(ctx, router, first.onQueued)
+		gone <- err
+	}()
+	waitQueued(t, first)
+
+	got := make(chan func(), 1)
+	go func() {
+		release, err := slots.acquire(context.Background(), router, second.onQueued)
+		if err != nil {
+			t.Error(err)
+		}
+		got <- release
+	}()
+	waitQueued(t, second)
+
+	cancel()
+	if err := <-gone; !errors.Is(err, context.Canceled) {
+		t.Fatalf("disconnected request: got %v", err)
+	}
+	waitQueued(t, second)
+	if positions := second.reported(); len(positions) != 2 || positions[0] != 2 || positions[1] != 1 {
+		t.Errorf("positions = %v, want [2 1]", positions)
+	}
+
+	// The slot goes to the remaining request, and then back to the pool
+	release()
+	select {
+	case release := <-got:
+		release()
+	case <-time.After(2 * time.Second):
+		t.Fatal("slot not handed over after the disconnect")
+	}
+	sem := slots.get(router)
+	sem.mu.Lock()
+	active, waiting := sem.active, len(sem.waiters)
+	sem.mu.Unlock()
+	if active != 0 || waiting != 0 {
+		t.Errorf("active = %d, waiting = %d after every request ended", active, waiting)
+	}
+}
+
+func TestRouterSlotsUnlimited(t *testing.T) {
+	slots := &slotManager{routers: make(map[string]*routerSemaphore)}
+	for i := 0; i < 10; i++ {
+		if _, err := slots.acquire(context.Background(), RouterConfig{Name: "r1"}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eAPI error code for commands that have no JSON model yet
+const eapiCodeNotConverted = 1003
+
+// EAPIError is a JSON-RPC error returned by Arista eAPI.
+type EAPIError struct {
+	Code    int
+	Message string
+}
+
+func (e *EAPIError) Error() string {
+	return fmt.Sprintf("eAPI error %d: %s", e.Code, e.Message)
+}
+
+type eapiRequest struct {
+	JSONRPC string     `json:"jsonrpc"`
+	Method  string     `json:"method"`
+	Params  eapiParams `json:"params"`
+	ID      string     `json:"id"`
+}
+
+type eapiParams struct {
+	Version int      `json:"version"`
+	Cmds    []string `json:"cmds"`
+	Format  string   `json:"format"`
+}
+
+type eapiResponse struct {
+	Result []json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Data    []struct {
+			Errors []string `json:"errors"`
+		} `json:"data"`
+	} `json:"error"`
+}
+
+// tlsConfigFor builds the TLS client configuration for HTTPS APIs: the
+// system roots, or only the certificates in caCertFile when set, and the
+// client certificate in certFile/keyFile for mutual TLS.
+func tlsConfigFor(conn ConnectionConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if conn.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conn.CertFile, conn.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if conn.CACertFile == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(conn.CACertFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", conn.CACertFile)
+	}
+	tlsConfig.RootCAs = pool
+	return tlsConfig, nil
+}
+
+// Idle keep-alive connections to HTTPS APIs are closed after this long
+const apiIdleConnTimeout = 90 * time.Second
+
+// apiClients holds one HTTP client per API endpoint and TLS settings
+var apiClients = struct {
+	sync.Mutex
+	clients map[string]*http.Client
+}{clients: make(map[string]*http.Client)}
+
+// apiClientFor returns the shared HTTP client for an HTTPS API connection,
+// so keep-alive connections are reused across commands instead of being
+// left behind by a new transport every time.
+func apiClientFor(conn ConnectionConfig) (*http.Client, error) {
+	key := strings.Join([]string{conn.Type, conn.URL, conn.Host, strconv.Itoa(conn.Port),
+		strconv.Itoa(conn.Timeout), conn.CACertFile, conn.CertFile, conn.KeyFile}, "|")
+
+	apiClients.Lock()
+	defer apiClients.Unlock()
+
+	if client, ok := apiClients.clients[key]; ok {
+		return client, nil
+	}
+	tlsConfig, err := tlsConfigFor(conn)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: connectTimeout(conn),
+		IdleConnTimeout:     apiIdleConnTimeout,
+	}}
+	apiClients.clients[key] = client
+	return client, nil
+}
+
+// closeAPIClients closes the idle connections of every API client, used on
+// server shutdown.
+func closeAPIClients() {
+	apiClients.Lock()
+	defer apiClients.Unlock()
+
+	for _, client := range apiClients.clients {
+		client.CloseIdleConnections()
+	}
+}
+
+// runCmds calls the eAPI runCmds method for one command and returns its
+// result object.
+func runCmds(ctx context.Context, client *http.Client, router RouterConfig, command, format string) (json.RawMessage, error) {
+	conn := router.Connection
+	port := conn.Port
+	if port == 0 {
+		port = 443
+	}
+
+	body, err := json.Marshal(eapiRequest{
+		JSONRPC: "2.0",
+		Method:  "runCmds",
+		Params:  eapiParams{Version: 1, Cmds: []string{command}, Format: format},
+		ID:      "looking-glass",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	url := "https://" + net.JoinHostPort(conn.Host, strconv.Itoa(port)) + "/command-api"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(conn.Username, conn.Password)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, errors.New("eAPI request timeout")
+		}
+		return nil, fmt.Errorf("eAPI request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, errors.New("eAPI authentication failed")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("eAPI returned HTTP %d", resp.StatusCode)
+	}
+
+	var result eapiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid eAPI response: %v", err)
+	}
+	if result.Error != nil {
+		// The per-command errors are more useful than the generic message
+		message := result.Error.Message
+		for _, data := range result.Error.Data {
+			if len(data.Errors) > 0 {
+				message = strings.Join(data.Errors, "; ")
+			}
+		}
+		return nil, &EAPIError{Code: result.Error.Code, Message: message}
+	}
+	if len(result.Result) == 0 {
+		return nil, errors.New("empty eAPI response")
+	}
+	return result.Result[0], nil
+}
+
+// runEAPICommand is the commandRunner for connection type "eapi" (Arista
+// EOS). Commands are run with JSON output; those EOS cannot render as JSON
+// are retried as text.
+func runEAPICommand(router RouterConfig, command string, timeout time.Duration, emit func(line string)) (any, error) {
+	client, err := apiClientFor(router.Connection)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result, err := runCmds(ctx, client, router, command, "json")
+	var eapiErr *EAPIError
+	if errors.As(err, &eapiErr) && eapiErr.Code == eapiCodeNotConverted {
+		result, err = runCmds(ctx, client, router, command, "text")
+		if err != nil {
+			return nil, err
+		}
+		var text struct {
+			Output string `json:"output"`
+		}
+		json.Unmarshal(result, &text)
+		emitLines(text.Output, emit)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Unconverted commands on recent EOS answer with their text as messages
+	var messages struct {
+		Messages []string `json:"messages"`
+	}
+	if json.Unmarshal(result, &messages) == nil && len(messages.Messages) > 0 {
+		for _, message := range messages.Messages {
+			emitLines(message, emit)
+		}
+		return result, nil
+	}
+
+	var pretty bytes.Buffer
+	json.Indent(&pretty, result, "", "  ")
+	emitLines(pretty.String(), emit)
+	return result, nil
+}
+
+func emitLines(text string, emit func(line string)) {
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		emit(strings.TrimRight(line, "\r"))
+	}
+}
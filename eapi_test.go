@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeTestCA saves the certificate of a TLS test server as a PEM file to
+// use as caCertFile.
+func writeTestCA(t *testing.T, server *httptest.Server) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(path, cert, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// startEAPIStub serves /command-api like an EOS switch that renders
+// "show version" as JSON, "show ip bgp summary" only as text and rejects
+// anything else. It counts the TCP connections it accepts.
+func startEAPIStub(t *testing.T) (RouterConfig, *atomic.Int32) {
+	t.Helper()
+
+	var conns atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/command-api" {
+			http.NotFound(w, r)
+			return
+		}
+		if user, password, ok := r.BasicAuth(); !ok || user != "admin" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req eapiRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Method != "runCmds" || len(req.Params.Cmds) != 1 {
+			t.Errorf("unexpected eAPI request %+v: %v", req, err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch cmd, format := req.Params.Cmds[0], req.Params.Format; {
+		case cmd == "show version" && format == "json":
+			w.Write([]byte(`{"jsonrpc": "2.0", "id": "looking-glass", "result": [{"version": "4.30.1F"}]}`))
+		case cmd == "show ip bgp summary" && format == "json":
+			w.Write([]byte(`{"jsonrpc": "2.0", "id": "looking-glass", "error": {"code": 1003, "message": "not converted"}}`))
+		case cmd == "show ip bgp summary" && format == "text":
+			w.Write([]byte(`{"jsonrpc": "2.0", "id": "looking-glass", "result": [{"output": "BGP summary information\r\nNeighbor  V  AS\n"}]}`))
+		default:
+			w.Write([]byte(`{"jsonrpc": "2.0", "id": "looking-glass", "error": {"code": 1002, "message": "CLI command 1 of 1 failed", "data": [{"errors": ["Invalid input"]}]}}`))
+		}
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	router := RouterConfig{Name: t.Name(), OSType: "eos", Connection: ConnectionConfig{
+		Type:       "eapi",
+		Host:       host,
+		Username:   "admin",
+		Password:   "secret",
+		CACertFile: writeTestCA(t, server),
+	}}
+	router.Connection.Port, _ = strconv.Atoi(port)
+	return router, &conns
+}
+
+func TestEAPIRunner(t *testing.T) {
+	router, conns := startEAPIStub(t)
+
+	run := func(router RouterConfig, command string) ([]string, any, error) {
+		var lines []string
+		result, err := runEAPICommand(router, command, 5*time.Second, func(line string) {
+			lines = append(lines, line)
+		})
+		return lines, result, err
+	}
+
+	t.Run("JSON result", func(t *testing.T) {
+		lines, result, err := run(router, "show version")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raw, ok := result.(json.RawMessage); !ok || !strings.Contains(string(raw), "4.30.1F") {
+			t.Errorf("result = %v", result)
+		}
+		if strings.Join(lines, "\n") != "{\n  \"version\": \"4.30.1F\"\n}" {
+			t.Errorf("output = %q", lines)
+		}
+	})
+
+	t.Run("text fallback", func(t *testing.T) {
+		lines, result, err := run(router, "show ip bgp summary")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != nil || len(lines) != 2 || lines[0] != "BGP summary information" {
+			t.Errorf("got %v, %q", result, lines)
+		}
+	})
+
+	t.Run("command error", func(t *testing.T) {
+		_, _, err := run(router, "show running-config")
+		if err == nil || err.Error() != "eAPI error 1002: Invalid input" {
+			t.Errorf("got %v", err)
+		}
+	})
+
+	t.Run("authentication", func(t *testing.T) {
+		wrong := router
+		wrong.Connection.Password = "wrong"
+		if _, _, err := run(wrong, "show version"); err == nil || err.Error() != "eAPI authentication failed" {
+			t.Errorf("got %v", err)
+		}
+	})
+
+	t.Run("untrusted certificate", func(t *testing.T) {
+		untrusted := router
+		untrusted.Connection.CACertFile = ""
+		if _, _, err := run(untrusted, "show version"); err == nil {
+			t.Error("request to a self-signed server succeeded without its CA")
+		}
+	})
+
+	t.Run("connection reuse", func(t *testing.T) {
+		before := conns.Load()
+		for i := 0; i < 5; i++ {
+			if _, _, err := run(router, "show version"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := conns.Load() - before; n > 0 {
+			t.Errorf("5 commands opened %d new connections, want the idle one reused", n)
+		}
+	})
+
+	closeAPIClients()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Overall limits for commands run through a commandRunner, matching the
+// SSH executors
+const (
+	commandTimeout          = 60 * time.Second
+	streamingCommandTimeout = 5 * time.Minute
+)
+
+// commandRunner executes a command on a router and calls emit for every
+// output line as soon as it is available. Runners talking to a structured
+// API may also return the result as data, which is sent as JSON next to the
+// text. Connection types other than SSH register one in commandRunners and
+// get both the streaming and the non-streaming API for free.
+type commandRunner func(router RouterConfig, command string, timeout time.Duration, emit func(line string)) (any, error)
+
+var commandRunners = map[string]commandRunner{
+	"bird":     runBirdCommand,
+	"vtysh":    runVtyshCommand,
+	"gobgp":    runGobgpCommand,
+	"bgpctl":   runBgpctlCommand,
+	"netconf":  runNetconfCommand,
+	"eapi":     runEAPICommand,
+	"routeros": runRouterOSCommand,
+	"local":    runLocalCommand,
+	"agent":    runAgentCommand,
+	"telnet":   runTelnetCommand,
+}
+
+// connectTimeout is the connection.timeout of a router, 20s if unset.
+func connectTimeout(conn ConnectionConfig) time.Duration {
+	if conn.Timeout > 0 {
+		return time.Duration(conn.Timeout) * time.Millisecond
+	}
+	return 20 * time.Second
+}
+
+// isExecSSH tells whether the router is handled by the SSH exec executors.
+func isExecSSH(router RouterConfig) bool {
+	switch router.Connection.Type {
+	case "", "ssh":
+		return !osProfiles[router.OSType].ShellOnly && router.ExecMode != execModeShell
+	}
+	return false
+}
+
+// runnerFor returns the commandRunner of the router's connection type.
+func runnerFor(router RouterConfig) (commandRunner, error) {
+	switch router.Connection.Type {
+	case "", "ssh":
+		return runSSHShellCommand, nil
+	}
+	runner, ok := commandRunners[router.Connection.Type]
+	if !ok {
+		return nil, fmt.Errorf("unsupported connection type %q", router.Connection.Type)
+	}
+	return runner, nil
+}
+
+// executeCommand runs the command using the router's connection type and
+// returns the whole output, plus the structured result when there is one.
+func executeCommand(router RouterConfig, command string) (string, json.RawMessage, error) {
+	if isExecSSH(router) {
+		output, err := executeSSHCommand(router, command)
+		if err != nil {
+			return "", nil, err
+		}
+		output, data := structuredOutput(output)
+		return output, data, nil
+	}
+
+	runner, err := runnerFor(router)
+	if err != nil {
+		return "", nil, err
+	}
+
+	filter := outputFilterFor(router)
+	var lines []string
+	result, err := runner(router, command, commandTimeout, func(line string) {
+		if line, ok := filter.apply(line); ok {
+			lines = append(lines, line)
+		}
+	})
+	output := strings.TrimSpace(strings.Join(lines, "\n"))
+	if err != nil && output == "" {
+		return "", nil, err
+	}
+	if result == nil {
+		output, data := structuredOutput(output)
+		return output, data, nil
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to encode result: %v", err)
+	}
+	return output, data, nil
+}
+
+// executeCommandStreaming is the streaming counterpart of executeCommand,
+// emitting the usual start/data/error/complete events.
+func executeCommandStreaming(router RouterConfig, command string, sendData func(StreamResponse)) {
+	if isExecSSH(router) {
+		executeSSHCommandStreaming(router, command, sendData)
+		return
+	}
+
+	sendData(StreamResponse{Type: "start", Command: command})
+
+	runner, err := runnerFor(router)
+	if err != nil {
+		sendData(StreamResponse{Type: "error", Error: err.Error()})
+		return
+	}
+
+	filter := outputFilterFor(router)
+	result, err := runner(router, command, streamingCommandTimeout, func(line string) {
+		if line, ok := filter.apply(line); ok {
+			sendData(StreamResponse{Type: "data", Data: line})
+		}
+	})
+	if err != nil {
+		sendData(StreamResponse{Type: "error", Error: err.Error()})
+		return
+	}
+
+	complete := StreamResponse{Type: "complete"}
+	if result != nil {
+		if data, err := json.Marshal(result); err == nil {
+			complete.Result = data
+		}
+	}
+	sendData(complete)
+}
+
+// structuredOutput detects JSON answers (FRR json commands and the like) and
+// returns them both pretty-printed for display and as raw data for API
+// clients. Anything else is returned unchanged with nil data.
+func structuredOutput(output string) (string, json.RawMessage) {
+	trimmed := strings.TrimSpace(output)
+	if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+		return output, nil
+	}
+	if !json.Valid([]byte(trimmed)) {
+		return output, nil
+	}
+
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, []byte(trimmed), "", "  "); err != nil {
+		return output, nil
+	}
+	return pretty.String(), json.RawMessage(trimmed)
+}
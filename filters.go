@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Actions of an output filter rule
+const (
+	filterDrop    = "drop"    // remove matching lines
+	filterRedact  = "redact"  // mask the matched text
+	filterReplace = "replace" // rewrite the matched text with Replacement
+)
+
+// Replaces the text matched by redact rules
+const redactedText = "[redacted]"
+
+// OutputFilter is a regex rule applied to every output line. Rules are set
+// per router (outputFilters), per OS type (the top-level outputFilters map,
+// "*" for every router) and by default in the OS profiles.
+type OutputFilter struct {
+	Action      string `json:"action"`
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"` // may use $1 etc. for submatches
+	re          *regexp.Regexp
+}
+
+func (f *OutputFilter) compile() error {
+	switch f.Action {
+	case filterDrop, filterRedact, filterReplace:
+	default:
+		return fmt.Errorf("unknown action %q", f.Action)
+	}
+	re, err := regexp.Compile(f.Pattern)
+	if err != nil {
+		return err
+	}
+	f.re = re
+	return nil
+}
+
+// dropLines builds the drop rules of an OS profile.
+func dropLines(patterns ...string) []OutputFilter {
+	rules := make([]OutputFilter, len(patterns))
+	for i, pattern := range patterns {
+		rules[i] = OutputFilter{Action: filterDrop, Pattern: pattern, re: regexp.MustCompile(pattern)}
+	}
+	return rules
+}
+
+// compileOutputFilters validates the filters of the config.
+func compileOutputFilters() error {
+	for i := range config.Routers {
+		router := &config.Routers[i]
+		for j := range router.OutputFilters {
+			if err := router.OutputFilters[j].compile(); err != nil {
+				return fmt.Errorf("router %s, output filter %d: %v", router.Name, j+1, err)
+			}
+		}
+	}
+	for osType, rules := range config.OutputFilters {
+		for j := range rules {
+			if err := rules[j].compile(); err != nil {
+				return fmt.Errorf("output filters of %s, filter %d: %v", osType, j+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+// lineFilter is the chain of rules applied to the output of a router.
+type lineFilter struct {
+	cli          bool           // the output comes from the router CLI
+	prompt       *regexp.Regexp // a prompt line
+	promptPrefix *regexp.Regexp // a prompt followed by the echoed input
+	rules        []OutputFilter
+}
+
+// outputFilterFor collects the rules of a router: prompt lines, with or
+// without the echoed input, and empty lines are dropped from CLI output,
+// then its own rules run, then those of its OS type and the defaults of its
+// OS profile.
+func outputFilterFor(router RouterConfig) lineFilter {
+	var rules []OutputFilter
+	rules = append(rules, router.OutputFilters...)
+	rules = append(rules, config.OutputFilters[router.OSType]...)
+	rules = append(rules, config.OutputFilters["*"]...)
+	rules = append(rules, osProfiles[router.OSType].OutputFilters...)
+
+	filter := lineFilter{rules: rules}
+	if isCLITransport(router) {
+		filter.cli = true
+		filter.prompt = routerPrompt(router)
+		filter.promptPrefix = routerPromptPrefix(router)
+	}
+	return filter
+}
+
+// isCLITransport tells whether the output of the router comes from its CLI
+// (SSH exec or shell, telnet), where prompts show up. Structured runners
+// only return data, which a prompt pattern could wrongly match.
+func isCLITransport(router RouterConfig) bool {
+	switch router.Connection.Type {
+	case "", "ssh", "telnet":
+		return true
+	}
+	return false
+}
+
+// apply returns the filtered line, or false when it must be dropped.
+// Leading whitespace is kept, it indents tables and JSON.
+func (f lineFilter) apply(line string) (string, bool) {
+	line = strings.TrimRightFunc(line, unicode.IsSpace)
+	if f.prompt != nil && f.prompt.MatchString(line) {
+		return "", false
+	}
+	if f.promptPrefix != nil && f.promptPrefix.MatchString(line) {
+		return "", false
+	}
+	for _, rule := range f.rules {
+		if rule.re == nil || !rule.re.MatchString(line) {
+			continue
+		}
+		switch rule.Action {
+		case filterDrop:
+			return "", false
+		case filterRedact:
+			line = rule.re.ReplaceAllString(line, redactedText)
+		case filterReplace:
+			line = rule.re.ReplaceAllString(line, rule.Replacement)
+		}
+	}
+	line = strings.TrimRightFunc(line, unicode.IsSpace)
+	return line, line != "" || !f.cli
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestOutputFilterPrompts(t *testing.T) {
+	tests := []struct {
+		connType string
+		line     string
+		kept     bool
+	}{
+		{"ssh", "<R1>", false},
+		{"ssh", "[~R1-bgp]", false},
+		{"", "[2001:db8::1]", false},
+		{"telnet", "<R1>", false},
+		// The prompt with the echoed command
+		{"ssh", "<netengine01>display bgp peer | no-more", false},
+		{"", "<netengine01>quit", false},
+		{"telnet", "[~netengine01-bgp]display this", false},
+		{"ssh", "Total Number of Routes: 5", true},
+		{"ssh", "  <R1>", true},
+		{"netconf", "[2001:db8::1]", true},
+		{"netconf", "<netengine01>quit", true},
+		{"agent", "<R1>", true},
+		{"gobgp", "[192.0.2.1]", true},
+	}
+
+	for _, tt := range tests {
+		router := RouterConfig{OSType: "huawei", Connection: ConnectionConfig{Type: tt.connType}}
+		if _, kept := outputFilterFor(router).apply(tt.line); kept != tt.kept {
+			t.Errorf("connection %q, line %q: kept %t, want %t", tt.connType, tt.line, kept, tt.kept)
+		}
+	}
+}
+
+func TestOutputFilterCustomPrompt(t *testing.T) {
+	router := RouterConfig{OSType: "huawei", Prompt: `edge1[>#]`}
+	router.prompt, _ = anchoredPrompt(router.Prompt)
+	router.promptPrefix = regexp.MustCompile(`^(?:` + router.Prompt + `)`)
+	filter := outputFilterFor(router)
+
+	for line, want := range map[string]bool{
+		"edge1#":                         false,
+		"edge1#show bgp summary":         false,
+		"peer edge1# down":               true,
+		"<netengine01>display this":      true,
+		"BGP router identifier 10.0.0.1": true,
+	} {
+		if _, kept := filter.apply(line); kept != want {
+			t.Errorf("line %q: kept %t, want %t", line, kept, want)
+		}
+	}
+}
+
+func TestOutputFilterWhitespace(t *testing.T) {
+	tests := []struct {
+		connType string
+		line     string
+		want     string
+		kept     bool
+	}{
+		{"ssh", "  Peer            V    AS  MsgRcvd\r", "  Peer            V    AS  MsgRcvd", true},
+		{"telnet", "\t192.0.2.1   4 64500     1234  \r", "\t192.0.2.1   4 64500     1234", true},
+		{"ssh", "   \r", "", false},
+		{"ssh", "", "", false},
+		// Structured output keeps its blank lines and indentation
+		{"gobgp", "", "", true},
+		{"vtysh", "    \"peers\": {", "    \"peers\": {", true},
+	}
+
+	for _, tt := range tests {
+		router := RouterConfig{OSType: "huawei", Connection: ConnectionConfig{Type: tt.connType}}
+		got, kept := outputFilterFor(router).apply(tt.line)
+		if kept != tt.kept || got != tt.want {
+			t.Errorf("connection %q, line %q: got %q, %t, want %q, %t", tt.connType, tt.line, got, kept, tt.want, tt.kept)
+		}
+	}
+}
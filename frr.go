@@ -0,0 +1,15 @@
+package main
+
+import (
+	"time"
+)
+
+// runVtyshCommand is the commandRunner for connection type "vtysh": FRR
+// running on the Looking Glass host itself.
+func runVtyshCommand(router RouterConfig, command string, timeout time.Duration, emit func(line string)) (any, error) {
+	vtysh := router.Connection.Binary
+	if vtysh == "" {
+		vtysh = "vtysh"
+	}
+	return nil, runProcess([]string{vtysh, "-c", command}, timeout, emit)
+}
@@ -1,2 +1,2 @@
 #!/bin/bash
-go build -o goline-looking-glass main.go
+go build -o goline-looking-glass .
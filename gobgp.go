@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	api "github.com/osrg/gobgp/v3/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// Default gRPC port of gobgpd
+const defaultGobgpPort = 50051
+
+// gobgpQuery is a command in gobgp CLI syntax, as used by the gobgp command
+// templates:
+//
+//	global rib -a ipv4 <address or prefix>
+//	neighbor <address> adj-out -a ipv4
+//	neighbor -a ipv4
+//	neighbor detail -a ipv4
+type gobgpQuery struct {
+	kind     string // "rib", "adj-out", "summary" or "detail"
+	ipv6     bool
+	prefix   string
+	neighbor string
+}
+
+func parseGobgpCommand(command string) (gobgpQuery, error) {
+	var q gobgpQuery
+	var args []string
+
+	fields := strings.Fields(command)
+	for i := 0; i < len(fields); i++ {
+		if fields[i] == "-a" && i+1 < len(fields) {
+			i++
+			switch fields[i] {
+			case "ipv4":
+			case "ipv6":
+				q.ipv6 = true
+			default:
+				return q, fmt.Errorf("unsupported address family %q", fields[i])
+			}
+			continue
+		}
+		args = append(args, fields[i])
+	}
+
+	switch {
+	case len(args) >= 2 && len(args) <= 3 && args[0] == "global" && args[1] == "rib":
+		q.kind = "rib"
+		if len(args) == 3 {
+			q.prefix = args[2]
+		}
+	case len(args) == 3 && args[0] == "neighbor" && args[2] == "adj-out":
+		q.kind = "adj-out"
+		q.neighbor = args[1]
+	case len(args) == 1 && args[0] == "neighbor":
+		q.kind = "summary"
+	case len(args) == 2 && args[0] == "neighbor" && args[1] == "detail":
+		q.kind = "detail"
+	default:
+		return q, fmt.Errorf("unsupported GoBGP command %q", command)
+	}
+	return q, nil
+}
+
+func (q gobgpQuery) family() *api.Family {
+	family := &api.Family{Afi: api.Family_AFI_IP, Safi: api.Family_SAFI_UNICAST}
+	if q.ipv6 {
+		family.Afi = api.Family_AFI_IP6
+	}
+	return family
+}
+
+// gobgpRoute is the structured form of a path in a GoBGP table.
+type gobgpRoute struct {
+	Prefix           string   `json:"prefix"`
+	Best             bool     `json:"best"`
+	NextHop          string   `json:"nextHop,omitempty"`
+	ASPath           []uint32 `json:"asPath"`
+	Origin           string   `json:"origin,omitempty"`
+	MED              *uint32  `json:"med,omitempty"`
+	LocalPref        *uint32  `json:"localPref,omitempty"`
+	Communities      []string `json:"communities,omitempty"`
+	LargeCommunities []string `json:"largeCommunities,omitempty"`
+	Neighbor         string   `json:"neighbor,omitempty"`
+	Age              string   `json:"age,omitempty"`
+	Filtered         bool     `json:"filtered,omitempty"`
+	Stale            bool     `json:"stale,omitempty"`
+
+	asPathText string
+	age        time.Duration
+}
+
+// gobgpNeighbor is the structured form of a BGP peer.
+type gobgpNeighbor struct {
+	Address     string `json:"address"`
+	ASN         uint32 `json:"asn"`
+	Description string `json:"description,omitempty"`
+	RouterID    string `json:"routerId,omitempty"`
+	State       string `json:"state"`
+	AdminDown   bool   `json:"adminDown,omitempty"`
+	Uptime      string `json:"uptime,omitempty"`
+	Received    uint64 `json:"received"`
+	Accepted    uint64 `json:"accepted"`
+	Advertised  uint64 `json:"advertised"`
+
+	up time.Duration
+}
+
+// runGobgpCommand is the commandRunner for connection type "gobgp". It talks
+// to the gobgpd gRPC API and renders the answer like the gobgp CLI, also
+// returning it as structured data.
+func runGobgpCommand(router RouterConfig, command string, timeout time.Duration, emit func(line string)) (any, error) {
+	q, err := parseGobgpCommand(command)
+	if err != nil {
+		return nil, err
+	}
+
+	host := router.Connection.Host
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	port := router.Connection.Port
+	if port == 0 {
+		port = defaultGobgpPort
+	}
+
+	conn, err := grpc.NewClient(net.JoinHostPort(host, strconv.Itoa(port)),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("GoBGP connection failed: %v", err)
+	}
+	defer conn.Close()
+	client := api.NewGobgpApiClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	switch q.kind {
+	case "rib", "adj-out":
+		return gobgpListPath(ctx, client, q, emit)
+	default:
+		return gobgpListPeer(ctx, client, q, emit)
+	}
+}
+
+// gobgpRecv reads every message of a server streaming call, passing each
+// one to handle.
+func gobgpRecv[T any](ctx context.Context, stream interface{ Recv() (T, error) }, handle func(T)) error {
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return gobgpError(ctx, err)
+		}
+		handle(resp)
+	}
+}
+
+func gobgpError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errors.New("GoBGP API timeout")
+	}
+	return fmt.Errorf("GoBGP API error: %s", status.Convert(err).Message())
+}
+
+func gobgpListPath(ctx context.Context, client api.GobgpApiClient, q gobgpQuery, emit func(line string)) (any, error) {
+	req := &api.ListPathRequest{
+		TableType: api.TableType_GLOBAL,
+		Family:    q.family(),
+		SortType:  api.ListPathRequest_PREFIX,
+	}
+	if q.kind == "adj-out" {
+		req.TableType = api.TableType_ADJ_OUT
+		req.Name = q.neighbor
+	}
+	if q.prefix != "" {
+		// Type EXACT; a bare address gets the longest match
+		req.Prefixes = []*api.TableLookupPrefix{{Prefix: q.prefix}}
+	}
+
+	stream, err := client.ListPath(ctx, req)
+	if err != nil {
+		return nil, gobgpError(ctx, err)
+	}
+
+	routes := []gobgpRoute{}
+	emit(fmt.Sprintf("   %-24s %-26s %-24s %-12s %s", "Network", "Next Hop", "AS_PATH", "Age", "Attrs"))
+	err = gobgpRecv(ctx, stream, func(resp *api.ListPathResponse) {
+		destination := resp.GetDestination()
+		for _, path := range destination.GetPaths() {
+			route := parseGobgpPath(destination.GetPrefix(), path)
+			routes = append(routes, route)
+			emit(formatGobgpRoute(route))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(routes) == 0 {
+		emit("Network not in table")
+	}
+	return routes, nil
+}
+
+func parseGobgpPath(prefix string, path *api.Path) gobgpRoute {
+	route := gobgpRoute{
+		Prefix:   prefix,
+		Best:     path.GetBest(),
+		Neighbor: path.GetNeighborIp(),
+		Filtered: path.GetFiltered(),
+		Stale:    path.GetStale(),
+		ASPath:   []uint32{},
+	}
+	if age := path.GetAge(); age != nil {
+		since := age.AsTime()
+		route.Age = since.UTC().Format(time.RFC3339)
+		route.age = time.Since(since)
+	}
+
+	var segments []string
+	for _, pattr := range path.GetPattrs() {
+		attr, err := pattr.UnmarshalNew()
+		if err != nil {
+			continue
+		}
+		switch attr := attr.(type) {
+		case *api.OriginAttribute:
+			route.Origin = [...]string{"i", "e", "?"}[min(int(attr.Origin), 2)]
+		case *api.AsPathAttribute:
+			for _, segment := range attr.Segments {
+				route.ASPath = append(route.ASPath, segment.Numbers...)
+				text := make([]string, len(segment.Numbers))
+				for i, asn := range segment.Numbers {
+					text[i] = strconv.FormatUint(uint64(asn), 10)
+				}
+				if segment.Type == api.AsSegment_AS_SET {
+					segments = append(segments, "{"+strings.Join(text, ",")+"}")
+				} else {
+					segments = append(segments, text...)
+				}
+			}
+		case *api.NextHopAttribute:
+			route.NextHop = attr.NextHop
+		case *api.MpReachNLRIAttribute:
+			if len(attr.NextHops) > 0 {
+				route.NextHop = attr.NextHops[0]
+			}
+		case *api.MultiExitDiscAttribute:
+			route.MED = &attr.Med
+		case *api.LocalPrefAttribute:
+			route.LocalPref = &attr.LocalPref
+		case *api.CommunitiesAttribute:
+			for _, c := range attr.Communities {
+				route.Communities = append(route.Communities, fmt.Sprintf("%d:%d", c>>16, c&0xffff))
+			}
+		case *api.LargeCommunitiesAttribute:
+			for _, c := range attr.Communities {
+				route.LargeCommunities = append(route.LargeCommunities, fmt.Sprintf("%d:%d:%d", c.GlobalAdmin, c.LocalData1, c.LocalData2))
+			}
+		}
+	}
+	route.asPathText = strings.Join(segments, " ")
+	return route
+}
+
+func formatGobgpRoute(route gobgpRoute) string {
+	marker := "*"
+	if route.Best {
+		marker = "*>"
+	}
+
+	var attrs []string
+	if route.Origin != "" {
+		attrs = append(attrs, "{Origin: "+route.Origin+"}")
+	}
+	if route.MED != nil {
+		attrs = append(attrs, fmt.Sprintf("{Med: %d}", *route.MED))
+	}
+	if route.LocalPref != nil {
+		attrs = append(attrs, fmt.Sprintf("{LocalPref: %d}", *route.LocalPref))
+	}
+	if len(route.Communities) > 0 {
+		attrs = append(attrs, "{Communities: "+strings.Join(route.Communities, ", ")+"}")
+	}
+	if len(route.LargeCommunities) > 0 {
+		attrs = append(attrs, "{LargeCommunity: [ "+strings.Join(route.LargeCommunities, ", ")+"]}")
+	}
+
+	return fmt.Sprintf("%-2s %-24s %-26s %-24s %-12s [%s]", marker, route.Prefix, route.NextHop,
+		route.asPathText, formatGobgpDuration(route.age), strings.Join(attrs, " "))
+}
+
+func gobgpListPeer(ctx context.Context, client api.GobgpApiClient, q gobgpQuery, emit func(line string)) (any, error) {
+	// No address lists every peer
+	stream, err := client.ListPeer(ctx, &api.ListPeerRequest{EnableAdvertised: true})
+	if err != nil {
+		return nil, gobgpError(ctx, err)
+	}
+
+	neighbors := []gobgpNeighbor{}
+	err = gobgpRecv(ctx, stream, func(resp *api.ListPeerResponse) {
+		neighbors = append(neighbors, parseGobgpPeer(resp.GetPeer(), q.ipv6))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Only show peers of the requested address family
+	filtered := neighbors[:0]
+	for _, n := range neighbors {
+		if addr, err := netip.ParseAddr(n.Address); err != nil || addr.Is6() == q.ipv6 {
+			filtered = append(filtered, n)
+		}
+	}
+	neighbors = filtered
+
+	if q.kind == "summary" {
+		emit(fmt.Sprintf("%-39s %10s %12s %-12s |%10s %10s", "Peer", "AS", "Up/Down", "State", "#Received", "Accepted"))
+		for _, n := range neighbors {
+			emit(fmt.Sprintf("%-39s %10d %12s %-12s |%10d %10d", n.Address, n.ASN,
+				formatGobgpDuration(n.up), n.State, n.Received, n.Accepted))
+		}
+		return neighbors, nil
+	}
+
+	for i, n := range neighbors {
+		if i > 0 {
+			emit("")
+		}
+		emit(fmt.Sprintf("BGP neighbor is %s, remote AS %d", n.Address, n.ASN))
+		if n.Description != "" {
+			emit("  Description: " + n.Description)
+		}
+		emit(fmt.Sprintf("  BGP version 4, remote router ID %s", n.RouterID))
+		state := fmt.Sprintf("  BGP state = %s", n.State)
+		if n.up > 0 {
+			state += ", up for " + formatGobgpDuration(n.up)
+		}
+		if n.AdminDown {
+			state += ", admin down"
+		}
+		emit(state)
+		emit(fmt.Sprintf("  Prefixes: received %d, accepted %d, advertised %d", n.Received, n.Accepted, n.Advertised))
+	}
+	return neighbors, nil
+}
+
+func parseGobgpPeer(peer *api.Peer, ipv6 bool) gobgpNeighbor {
+	conf, state := peer.GetConf(), peer.GetState()
+
+	n := gobgpNeighbor{
+		Address:     state.GetNeighborAddress(),
+		ASN:         state.GetPeerAsn(),
+		Description: conf.GetDescription(),
+		RouterID:    state.GetRouterId(),
+		State:       state.GetSessionState().String(),
+		AdminDown:   state.GetAdminState() == api.PeerState_DOWN,
+	}
+	if n.Address == "" {
+		n.Address = conf.GetNeighborAddress()
+	}
+	if n.ASN == 0 {
+		n.ASN = conf.GetPeerAsn()
+	}
+
+	// Only meaningful while established
+	uptime := peer.GetTimers().GetState().GetUptime()
+	if uptime != nil && state.GetSessionState() == api.PeerState_ESTABLISHED {
+		since := uptime.AsTime()
+		n.Uptime = since.UTC().Format(time.RFC3339)
+		n.up = time.Since(since)
+	}
+
+	family := (gobgpQuery{ipv6: ipv6}).family()
+	for _, afiSafi := range peer.GetAfiSafis() {
+		afiState := afiSafi.GetState()
+		if afiState.GetFamily().GetAfi() == family.Afi && afiState.GetFamily().GetSafi() == family.Safi {
+			n.Received = afiState.GetReceived()
+			n.Accepted = afiState.GetAccepted()
+			n.Advertised = afiState.GetAdvertised()
+		}
+	}
+	return n
+}
+
+// formatGobgpDuration prints a duration like the gobgp CLI: hh:mm:ss, with
+// days prepended when needed.
+func formatGobgpDuration(d time.Duration) string {
+	if d <= 0 {
+		return "never"
+	}
+	d = d.Round(time.Second)
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	hms := fmt.Sprintf("%02d:%02d:%02d", d/time.Hour, (d%time.Hour)/time.Minute, (d%time.Minute)/time.Second)
+	if days > 0 {
+		return fmt.Sprintf("%dd %s", days, hms)
+	}
+	return hms
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/osrg/gobgp/v3/api"
+	gobgplog "github.com/osrg/gobgp/v3/pkg/log"
+	"github.com/osrg/gobgp/v3/pkg/server"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func freeTCPPort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startGobgpd runs an in-process gobgpd with its gRPC API on grpcPort (0 for
+// none) and BGP on bgpPort.
+func startGobgpd(t *testing.T, asn uint32, routerID string, grpcPort, bgpPort int) *server.BgpServer {
+	t.Helper()
+
+	logger := gobgplog.NewDefaultLogger()
+	logger.SetLevel(gobgplog.ErrorLevel)
+	opts := []server.ServerOption{server.LoggerOption(logger)}
+	if grpcPort != 0 {
+		opts = append(opts, server.GrpcListenAddress(net.JoinHostPort("127.0.0.1", strconv.Itoa(grpcPort))))
+	}
+
+	s := server.NewBgpServer(opts...)
+	go s.Serve()
+	t.Cleanup(s.Stop)
+
+	err := s.StartBgp(context.Background(), &api.StartBgpRequest{Global: &api.Global{
+		Asn:             asn,
+		RouterId:        routerID,
+		ListenPort:      int32(bgpPort),
+		ListenAddresses: []string{"127.0.0.1"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The gRPC API is started in the background
+	for i := 0; grpcPort != 0; i++ {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(grpcPort)))
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatalf("gobgpd gRPC API not listening: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return s
+}
+
+func mustAny(t *testing.T, m proto.Message) *anypb.Any {
+	t.Helper()
+	a, err := anypb.New(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func addGobgpPath(t *testing.T, s *server.BgpServer, prefix string, length uint32, attrs ...proto.Message) {
+	t.Helper()
+
+	family := &api.Family{Afi: api.Family_AFI_IP, Safi: api.Family_SAFI_UNICAST}
+	if strings.Contains(prefix, ":") {
+		family.Afi = api.Family_AFI_IP6
+	}
+	path := &api.Path{
+		Family: family,
+		Nlri:   mustAny(t, &api.IPAddressPrefix{Prefix: prefix, PrefixLen: length}),
+	}
+	for _, attr := range attrs {
+		path.Pattrs = append(path.Pattrs, mustAny(t, attr))
+	}
+	if _, err := s.AddPath(context.Background(), &api.AddPathRequest{Path: path}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGobgpBackend(t *testing.T) {
+	grpcPort, bgpPort, peerPort := freeTCPPort(t), freeTCPPort(t), freeTCPPort(t)
+
+	// The collector the looking glass queries
+	collector := startGobgpd(t, 65001, "192.0.2.1", grpcPort, bgpPort)
+	addGobgpPath(t, collector, "198.51.100.0", 24,
+		&api.OriginAttribute{Origin: 0},
+		&api.NextHopAttribute{NextHop: "192.0.2.254"},
+		&api.AsPathAttribute{Segments: []*api.AsSegment{{Type: api.AsSegment_AS_SEQUENCE, Numbers: []uint32{64500, 64501}}}},
+		&api.MultiExitDiscAttribute{Med: 10},
+		&api.CommunitiesAttribute{Communities: []uint32{65001<<16 | 100}},
+		&api.LargeCommunitiesAttribute{Communities: []*api.LargeCommunity{{GlobalAdmin: 65001, LocalData1: 1, LocalData2: 2}}},
+	)
+	addGobgpPath(t, collector, "2001:db8:100::", 48,
+		&api.OriginAttribute{Origin: 2},
+		&api.MpReachNLRIAttribute{
+			Family:   &api.Family{Afi: api.Family_AFI_IP6, Safi: api.Family_SAFI_UNICAST},
+			NextHops: []string{"2001:db8::254"},
+			Nlris:    []*anypb.Any{mustAny(t, &api.IPAddressPrefix{Prefix: "2001:db8:100::", PrefixLen: 48})},
+		},
+		&api.AsPathAttribute{Segments: []*api.AsSegment{{Type: api.AsSegment_AS_SEQUENCE, Numbers: []uint32{64510}}}},
+	)
+	err := collector.AddPeer(context.Background(), &api.AddPeerRequest{Peer: &api.Peer{
+		Conf:      &api.PeerConf{NeighborAddress: "127.0.0.1", PeerAsn: 65002, Description: "test peer"},
+		Transport: &api.Transport{PassiveMode: true},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A peer that the collector advertises its routes to
+	peer := startGobgpd(t, 65002, "192.0.2.2", 0, peerPort)
+	err = peer.AddPeer(context.Background(), &api.AddPeerRequest{Peer: &api.Peer{
+		Conf:      &api.PeerConf{NeighborAddress: "127.0.0.1", PeerAsn: 65001},
+		Transport: &api.Transport{RemotePort: uint32(bgpPort)},
+		Timers:    &api.Timers{Config: &api.TimersConfig{ConnectRetry: 1}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := RouterConfig{Name: "collector", OSType: "gobgp", Connection: ConnectionConfig{
+		Type: "gobgp",
+		Host: "127.0.0.1",
+		Port: grpcPort,
+	}}
+	run := func(command string) ([]string, any) {
+		t.Helper()
+		var lines []string
+		result, err := runGobgpCommand(router, command, 5*time.Second, func(line string) {
+			lines = append(lines, line)
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", command, err)
+		}
+		return lines, result
+	}
+
+	t.Run("route lookup", func(t *testing.T) {
+		lines, result := run("global rib -a ipv4 198.51.100.7")
+		routes := result.([]gobgpRoute)
+		if len(routes) != 1 {
+			t.Fatalf("got %d routes: %v", len(routes), lines)
+		}
+		r := routes[0]
+		if r.Prefix != "198.51.100.0/24" || !r.Best || r.NextHop != "192.0.2.254" || r.Origin != "i" {
+			t.Errorf("unexpected route %+v", r)
+		}
+		if len(r.ASPath) != 2 || r.ASPath[0] != 64500 || r.ASPath[1] != 64501 {
+			t.Errorf("AS path = %v", r.ASPath)
+		}
+		if r.MED == nil || *r.MED != 10 {
+			t.Errorf("MED = %v", r.MED)
+		}
+		if len(r.Communities) != 1 || r.Communities[0] != "65001:100" {
+			t.Errorf("communities = %v", r.Communities)
+		}
+		if len(r.LargeCommunities) != 1 || r.LargeCommunities[0] != "65001:1:2" {
+			t.Errorf("large communities = %v", r.LargeCommunities)
+		}
+		if len(lines) != 2 || !strings.HasPrefix(lines[1], "*> 198.51.100.0/24") || !strings.Contains(lines[1], "64500 64501") {
+			t.Errorf("text output = %q", lines)
+		}
+	})
+
+	t.Run("IPv6 route lookup", func(t *testing.T) {
+		_, result := run("global rib -a ipv6 2001:db8:100::/48")
+		routes := result.([]gobgpRoute)
+		if len(routes) != 1 || routes[0].NextHop != "2001:db8::254" || routes[0].Origin != "?" {
+			t.Fatalf("routes = %+v", routes)
+		}
+	})
+
+	t.Run("not in table", func(t *testing.T) {
+		lines, result := run("global rib -a ipv4 203.0.113.1")
+		if len(result.([]gobgpRoute)) != 0 || lines[len(lines)-1] != "Network not in table" {
+			t.Errorf("got %q", lines)
+		}
+	})
+
+	// Wait for the session before looking at the neighbor and adj-out
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		_, result := run("neighbor -a ipv4")
+		neighbors := result.([]gobgpNeighbor)
+		if len(neighbors) == 1 && neighbors[0].State == "ESTABLISHED" && neighbors[0].Advertised > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("BGP session not established: %+v", neighbors)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	t.Run("summary", func(t *testing.T) {
+		lines, result := run("neighbor -a ipv4")
+		n := result.([]gobgpNeighbor)[0]
+		if n.Address != "127.0.0.1" || n.ASN != 65002 || n.Advertised != 1 || n.Uptime == "" {
+			t.Errorf("neighbor = %+v", n)
+		}
+		if len(lines) != 2 || !strings.Contains(lines[1], "ESTABLISHED") {
+			t.Errorf("text output = %q", lines)
+		}
+	})
+
+	t.Run("detail", func(t *testing.T) {
+		lines, _ := run("neighbor detail -a ipv4")
+		text := strings.Join(lines, "\n")
+		for _, want := range []string{"BGP neighbor is 127.0.0.1, remote AS 65002", "Description: test peer", "remote router ID 192.0.2.2", "BGP state = ESTABLISHED"} {
+			if !strings.Contains(text, want) {
+				t.Errorf("detail output misses %q:\n%s", want, text)
+			}
+		}
+	})
+
+	t.Run("IPv6 peers only", func(t *testing.T) {
+		_, result := run("neighbor -a ipv6")
+		if n := result.([]gobgpNeighbor); len(n) != 0 {
+			t.Errorf("IPv6 summary lists %+v", n)
+		}
+	})
+
+	t.Run("advertised routes", func(t *testing.T) {
+		_, result := run("neighbor 127.0.0.1 adj-out -a ipv4")
+		routes := result.([]gobgpRoute)
+		if len(routes) != 1 || routes[0].Prefix != "198.51.100.0/24" {
+			t.Fatalf("adj-out = %+v", routes)
+		}
+		// eBGP prepends the collector AS
+		if p := routes[0].ASPath; len(p) != 3 || p[0] != 65001 {
+			t.Errorf("advertised AS path = %v", p)
+		}
+	})
+
+	t.Run("API error", func(t *testing.T) {
+		_, err := runGobgpCommand(router, "neighbor 192.0.2.99 adj-out -a ipv4", 5*time.Second, func(string) {})
+		if err == nil || !strings.HasPrefix(err.Error(), "GoBGP API error") {
+			t.Errorf("unknown neighbor: got %v", err)
+		}
+	})
+}
+
+func TestParseGobgpCommand(t *testing.T) {
+	for _, command := range []string{"global rib -a ipv5 1.2.3.4", "neighbor 1.2.3.4 adj-in -a ipv4", "show ip bgp"} {
+		if _, err := parseGobgpCommand(command); err == nil {
+			t.Errorf("parseGobgpCommand(%q) succeeded", command)
+		}
+	}
+}
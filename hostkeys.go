@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Used when ssh.knownHostsFile is not configured
+const defaultKnownHostsFile = "known_hosts"
+
+// Serializes TOFU writes so two first connections don't both append a line
+var knownHostsMutex sync.Mutex
+
+// HostKeyError is returned by the host key callback when the key presented by
+// a router is unknown or does not match what we expect.
+type HostKeyError struct {
+	Host        string
+	Fingerprint string
+	Reason      string
+}
+
+func (e *HostKeyError) Error() string {
+	return fmt.Sprintf("host key verification failed for %s (%s): %s", e.Host, e.Fingerprint, e.Reason)
+}
+
+// hostKeyCallback returns the callback used to verify the key of a router.
+// Pinned fingerprints in the router config take precedence over the
+// known_hosts file; unknown hosts are only accepted in trust-on-first-use mode.
+func hostKeyCallback(router RouterConfig) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+
+		if len(router.HostKeyFingerprints) > 0 {
+			for _, pinned := range router.HostKeyFingerprints {
+				if pinned == fingerprint || pinned == ssh.FingerprintLegacyMD5(key) {
+					return nil
+				}
+			}
+			return &HostKeyError{Host: hostname, Fingerprint: fingerprint, Reason: "key does not match pinned fingerprint"}
+		}
+
+		return checkKnownHosts(hostname, remote, key)
+	}
+}
+
+func knownHostsFile() string {
+	if config.SSH.KnownHostsFile != "" {
+		return config.SSH.KnownHostsFile
+	}
+	return defaultKnownHostsFile
+}
+
+// Key looked up in known_hosts to list the keys of a host: it never matches
+var probeHostKey, _ = ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+
+// knownHostKeyAlgorithms returns the host key algorithms of the keys
+// known_hosts has for addr, nil if it has none. Without them the server may
+// present a key of another type, which fails verification as a mismatch.
+func knownHostKeyAlgorithms(addr string) []string {
+	knownHostsMutex.Lock()
+	defer knownHostsMutex.Unlock()
+
+	callback, err := knownhosts.New(knownHostsFile())
+	if err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(callback(addr, &net.TCPAddr{}, probeHostKey), &keyErr) {
+		return nil
+	}
+
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		keyAlgorithms := []string{known.Key.Type()}
+		if known.Key.Type() == ssh.KeyAlgoRSA {
+			keyAlgorithms = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+		}
+		for _, algorithm := range keyAlgorithms {
+			if !slices.Contains(algorithms, algorithm) {
+				algorithms = append(algorithms, algorithm)
+			}
+		}
+	}
+	return algorithms
+}
+
+func checkKnownHosts(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	fingerprint := ssh.FingerprintSHA256(key)
+	file := knownHostsFile()
+
+	knownHostsMutex.Lock()
+	defer knownHostsMutex.Unlock()
+
+	if _, err := os.Stat(file); err == nil {
+		callback, err := knownhosts.New(file)
+		if err != nil {
+			return fmt.Errorf("failed to load known_hosts %s: %v", file, err)
+		}
+
+		err = callback(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) > 0 {
+			return &HostKeyError{Host: hostname, Fingerprint: fingerprint, Reason: "key does not match known_hosts, possible man-in-the-middle"}
+		}
+		var revokedErr *knownhosts.RevokedError
+		if errors.As(err, &revokedErr) {
+			return &HostKeyError{Host: hostname, Fingerprint: fingerprint, Reason: "key is revoked in known_hosts"}
+		}
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to stat known_hosts %s: %v", file, err)
+	}
+
+	// Host is not in known_hosts at all
+	if !config.SSH.TrustOnFirstUse {
+		return &HostKeyError{Host: hostname, Fingerprint: fingerprint, Reason: "unknown host key"}
+	}
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to record host key in %s: %v", file, err)
+	}
+	defer f.Close()
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		return fmt.Errorf("failed to record host key in %s: %v", file, err)
+	}
+
+	log.Printf("Trusting new host key for %s on first use: %s", hostname, fingerprint)
+	return nil
+}
+
+// sshErrorMessage turns an SSH dial error into the message shown to clients,
+// making host key failures stand out from ordinary connection problems.
+func sshErrorMessage(err error) string {
+	var hostKeyErr *HostKeyError
+	if errors.As(err, &hostKeyErr) {
+		return fmt.Sprintf("SSH %v", hostKeyErr)
+	}
+	return fmt.Sprintf("SSH connection failed: %v", err)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startKnownHostsServer runs an SSH server accepting password "secret" with
+// an ECDSA and an ed25519 host key, and returns a router without pinned
+// fingerprints and the ed25519 key.
+func startKnownHostsServer(t *testing.T) (RouterConfig, ssh.PublicKey, ssh.PublicKey) {
+	t.Helper()
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaSigner, err := ssh.NewSignerFromKey(ecdsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "secret" {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		},
+	}
+	serverConfig.AddHostKey(ecdsaSigner)
+
+	router, ed25519Signer := serveTestSSH(t, serverConfig)
+	router.HostKeyFingerprints = nil
+	router.Connection.Password = "secret"
+	return router, ed25519Signer.PublicKey(), ecdsaSigner.PublicKey()
+}
+
+// useKnownHosts points config.SSH at a known_hosts file holding lines.
+func useKnownHosts(t *testing.T, trustOnFirstUse bool, lines ...string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	if len(lines) > 0 {
+		if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved := config.SSH
+	t.Cleanup(func() { config.SSH = saved })
+	config.SSH.KnownHostsFile = path
+	config.SSH.TrustOnFirstUse = trustOnFirstUse
+	return path
+}
+
+func routerAddr(router RouterConfig) string {
+	return fmt.Sprintf("%s:%d", router.Connection.Host, router.Connection.Port)
+}
+
+func TestKnownHosts(t *testing.T) {
+	router, ed25519Key, _ := startKnownHostsServer(t)
+	host := knownhosts.Normalize(routerAddr(router))
+
+	_, otherKey := writeTestKey(t)
+	revokedLine := "@revoked * " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ed25519Key)))
+
+	tests := []struct {
+		name   string
+		lines  []string
+		reason string // empty when the connection must succeed
+	}{
+		// The server prefers its ECDSA key: only the known ed25519 one must
+		// be asked for
+		{"match", []string{knownhosts.Line([]string{host}, ed25519Key)}, ""},
+		{"mismatch", []string{knownhosts.Line([]string{host}, otherKey.PublicKey())}, "key does not match known_hosts"},
+		{"revoked", []string{revokedLine, knownhosts.Line([]string{host}, ed25519Key)}, "key is revoked"},
+		{"unknown host", []string{knownhosts.Line([]string{"[192.0.2.1]:22"}, ed25519Key)}, "unknown host key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useKnownHosts(t, false, tt.lines...)
+
+			client, err := dialSSH(router)
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatalf("dialSSH failed: %v", err)
+				}
+				client.Close()
+				return
+			}
+			if err == nil {
+				client.Close()
+				t.Fatal("dialSSH succeeded")
+			}
+			var hostKeyErr *HostKeyError
+			if !errors.As(err, &hostKeyErr) || !strings.Contains(hostKeyErr.Reason, tt.reason) {
+				t.Errorf("got %v, want a host key error %q", err, tt.reason)
+			}
+		})
+	}
+}
+
+func TestKnownHostsTrustOnFirstUse(t *testing.T) {
+	router, _, ecdsaKey := startKnownHostsServer(t)
+	path := useKnownHosts(t, true)
+
+	client, err := dialSSH(router)
+	if err != nil {
+		t.Fatalf("first connection failed: %v", err)
+	}
+	client.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := knownhosts.Line([]string{knownhosts.Normalize(routerAddr(router))}, ecdsaKey)
+	if strings.TrimSpace(string(data)) != want {
+		t.Fatalf("known_hosts = %q, want %q", data, want)
+	}
+
+	// The recorded key is enforced from now on
+	config.SSH.TrustOnFirstUse = false
+	client, err = dialSSH(router)
+	if err != nil {
+		t.Fatalf("second connection failed: %v", err)
+	}
+	client.Close()
+}
+
+func TestKnownHostKeyAlgorithms(t *testing.T) {
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := ssh.NewPublicKey(&rsaPrivate.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Signer := writeTestKey(t)
+	useKnownHosts(t, false,
+		knownhosts.Line([]string{"router1.example.net"}, ed25519Signer.PublicKey()),
+		knownhosts.Line([]string{"router1.example.net", "192.0.2.1"}, ed25519Signer.PublicKey()),
+		knownhosts.Line([]string{"[router2.example.net]:2222"}, rsaKey),
+	)
+
+	if got := knownHostKeyAlgorithms("router1.example.net:22"); strings.Join(got, ",") != ssh.KeyAlgoED25519 {
+		t.Errorf("router1 algorithms = %v", got)
+	}
+	want := strings.Join([]string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}, ",")
+	if got := knownHostKeyAlgorithms("router2.example.net:2222"); strings.Join(got, ",") != want {
+		t.Errorf("router2 algorithms = %v, want %s", got, want)
+	}
+	if got := knownHostKeyAlgorithms("router3.example.net:22"); got != nil {
+		t.Errorf("unknown host algorithms = %v, want none", got)
+	}
+	config.SSH.KnownHostsFile = filepath.Join(t.TempDir(), "missing")
+	if got := knownHostKeyAlgorithms("router1.example.net:22"); got != nil {
+		t.Errorf("missing known_hosts algorithms = %v, want none", got)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Values of RouterConfig.ExecMode
+const (
+	execModeExec  = "exec"
+	execModeShell = "shell"
+)
+
+// Prompt of interactive sessions on OSes without a Prompt of their own
+var defaultCLIPrompt = regexp.MustCompile(`^\S+[>#\]$%]\s*$`)
+
+var ansiEscapeRegex = regexp.MustCompile(`\x1b\[[0-9;?]*[a-zA-Z]`)
+
+// anchoredPrompt turns a prompt regex into one matching a whole line that
+// is only the prompt.
+func anchoredPrompt(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile(`(?:` + pattern + `)\s*$`)
+}
+
+// The OS prompts, anchored
+var osPrompts = func() map[string]*regexp.Regexp {
+	prompts := make(map[string]*regexp.Regexp)
+	for osType, profile := range osProfiles {
+		if profile.Prompt != nil {
+			prompt, err := anchoredPrompt(profile.Prompt.String())
+			if err != nil {
+				panic(fmt.Sprintf("prompt of %s: %v", osType, err))
+			}
+			prompts[osType] = prompt
+		}
+	}
+	return prompts
+}()
+
+// routerPrompt returns the regex matching a bare prompt line of the router:
+// its own prompt setting or else the one of its OS, nil if neither.
+func routerPrompt(router RouterConfig) *regexp.Regexp {
+	if router.prompt != nil {
+		return router.prompt
+	}
+	return osPrompts[router.OSType]
+}
+
+// routerPromptPrefix returns the pattern of a line starting with the
+// router prompt, such as the prompt followed by the echoed command.
+func routerPromptPrefix(router RouterConfig) *regexp.Regexp {
+	if router.promptPrefix != nil {
+		return router.promptPrefix
+	}
+	return osProfiles[router.OSType].Prompt
+}
+
+// compileRouterPrompts validates the execMode and prompt of every router.
+func compileRouterPrompts() error {
+	for i := range config.Routers {
+		router := &config.Routers[i]
+		switch router.ExecMode {
+		case "", execModeExec, execModeShell:
+		default:
+			return fmt.Errorf("router %s has unknown execMode %q", router.Name, router.ExecMode)
+		}
+		if router.Prompt == "" {
+			continue
+		}
+		prompt, err := anchoredPrompt(router.Prompt)
+		if err != nil {
+			return fmt.Errorf("router %s has an invalid prompt: %v", router.Name, err)
+		}
+		router.prompt = prompt
+		router.promptPrefix = regexp.MustCompile(`^(?:` + router.Prompt + `)`)
+	}
+	return nil
+}
+
+// Time without further output after which a last line that looks like a
+// prompt is taken as the prompt, and not as the start of an output line
+// split across reads
+const cliPromptQuiet = 300 * time.Millisecond
+
+// cliSession drives an interactive CLI (PTY shell or telnet) by waiting for
+// prompts. Call close when done with it.
+type cliSession struct {
+	w       io.Writer
+	r       io.Reader
+	newline string
+	pending string
+
+	chunks chan cliChunk // output of r, read in the background
+	done   chan struct{}
+}
+
+type cliChunk struct {
+	data string
+	err  error
+}
+
+// read returns the chunks read from r, starting the reader on first use.
+func (s *cliSession) read() <-chan cliChunk {
+	if s.chunks != nil {
+		return s.chunks
+	}
+	s.chunks = make(chan cliChunk)
+	s.done = make(chan struct{})
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := s.r.Read(buf)
+			select {
+			case s.chunks <- cliChunk{data: string(buf[:n]), err: err}:
+			case <-s.done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return s.chunks
+}
+
+// close stops the background reader. It ends once its pending Read
+// returns, so the connection must be closed as well.
+func (s *cliSession) close() {
+	if s.done != nil {
+		close(s.done)
+	}
+}
+
+// send types a line.
+func (s *cliSession) send(line string) error {
+	_, err := io.WriteString(s.w, line+s.newline)
+	return err
+}
+
+// expect reads until the unterminated last line matches one of the
+// patterns, with no more output for cliPromptQuiet, and returns its index.
+// Complete lines received meanwhile are passed to onLine, if set.
+func (s *cliSession) expect(onLine func(line string), patterns ...*regexp.Regexp) (int, error) {
+	chunks := s.read()
+	for {
+		for {
+			i := strings.IndexByte(s.pending, '\n')
+			if i < 0 {
+				break
+			}
+			line := cleanTerminalLine(s.pending[:i])
+			s.pending = s.pending[i+1:]
+			if onLine != nil {
+				onLine(line)
+			}
+		}
+
+		tail := cleanTerminalLine(s.pending)
+		match := -1
+		for i, pattern := range patterns {
+			if pattern.MatchString(tail) {
+				match = i
+				break
+			}
+		}
+
+		var quiet <-chan time.Time
+		if match >= 0 {
+			quiet = time.After(cliPromptQuiet)
+		}
+		select {
+		case chunk := <-chunks:
+			s.pending += chunk.data
+			if chunk.err != nil {
+				return -1, chunk.err
+			}
+		case <-quiet:
+			s.pending = ""
+			return match, nil
+		}
+	}
+}
+
+// run disables paging, types the command and emits its output up to the
+// next prompt, without the echoed command. Prompt lines within the output
+// are left to the output filter.
+func (s *cliSession) run(router RouterConfig, command string, emit func(line string)) error {
+	prompt := routerPrompt(router)
+	if prompt == nil {
+		prompt = defaultCLIPrompt
+	}
+
+	for _, disable := range osProfiles[router.OSType].DisablePaging {
+		if err := s.send(disable); err != nil {
+			return fmt.Errorf("failed to send command: %v", err)
+		}
+		if _, err := s.expect(nil, prompt); err != nil {
+			return err
+		}
+	}
+
+	if err := s.send(command); err != nil {
+		return fmt.Errorf("failed to send command: %v", err)
+	}
+	echoed := false
+	_, err := s.expect(func(line string) {
+		if !echoed && strings.HasSuffix(strings.TrimSpace(line), command) {
+			echoed = true
+			return
+		}
+		echoed = true
+		emit(line)
+	}, prompt)
+	return err
+}
+
+// cleanTerminalLine removes escape sequences and carriage returns.
+func cleanTerminalLine(line string) string {
+	line = ansiEscapeRegex.ReplaceAllString(line, "")
+	if i := strings.LastIndexByte(strings.TrimRight(line, "\r"), '\r'); i >= 0 {
+		// Text overwritten with a bare CR (spinners, pager leftovers)
+		line = line[i+1:]
+	}
+	return strings.TrimRight(line, "\r")
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeCLI writes the chunks to a cliSession one after the other, waiting
+// pause between them.
+func fakeCLI(pause time.Duration, chunks ...string) *cliSession {
+	r, w := io.Pipe()
+	go func() {
+		for _, chunk := range chunks {
+			io.WriteString(w, chunk)
+			time.Sleep(pause)
+		}
+	}()
+	return &cliSession{w: io.Discard, r: r, newline: "\n"}
+}
+
+func TestCLISessionOutputSplitAtPromptLikeText(t *testing.T) {
+	// The first read ends in the middle of a line, just after text that
+	// looks like a prompt
+	s := fakeCLI(50*time.Millisecond,
+		"show interfaces description\r\nEth1  uplink\r\nfoo#",
+		"bar  customer\r\nEth3  spare\r\n",
+		"router1#",
+	)
+	defer s.close()
+
+	var lines []string
+	err := s.run(RouterConfig{OSType: "unknown"}, "show interfaces description", func(line string) {
+		lines = append(lines, line)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Eth1  uplink", "foo#bar  customer", "Eth3  spare"}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("output = %q, want %q", lines, want)
+	}
+}
+
+func TestCLISessionPromptQuiet(t *testing.T) {
+	s := fakeCLI(0, "banner\r\n<R1>")
+	defer s.close()
+
+	start := time.Now()
+	if _, err := s.expect(nil, routerPrompt(RouterConfig{OSType: "huawei"})); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < cliPromptQuiet || elapsed > cliPromptQuiet+time.Second {
+		t.Errorf("prompt taken after %s, want about %s", elapsed, cliPromptQuiet)
+	}
+}
+
+func TestOSPromptsAnchored(t *testing.T) {
+	prompt := routerPrompt(RouterConfig{OSType: "huawei"})
+	for line, want := range map[string]bool{
+		"<R1>":                      true,
+		"[~R1] ":                    true,
+		"<R1>display bgp peer":      false,
+		"[R1-bgp]display this":      false,
+		"Total number of routes: 5": false,
+	} {
+		if got := prompt.MatchString(line); got != want {
+			t.Errorf("huawei prompt matches %q: %t, want %t", line, got, want)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// JumpHostConfig is an SSH bastion a router is reached through. A jump host
+// can have its own jumpHost, the hop in front of it, for multi-hop paths.
+type JumpHostConfig struct {
+	Host           string   `json:"host"`
+	Port           int      `json:"port"` // default 22
+	Username       string   `json:"username"`
+	Password       string   `json:"password"`
+	PrivateKeyFile string   `json:"privateKeyFile"`
+	Passphrase     string   `json:"passphrase"`
+	AgentSocket    string   `json:"agentSocket"`
+	AuthOrder      []string `json:"authOrder"`
+
+	HostKeyFingerprints []string        `json:"hostKeyFingerprints"`
+	SSHProfile          string          `json:"sshProfile"`
+	JumpHost            *JumpHostConfig `json:"jumpHost"`
+}
+
+// String names the jump host and the hops in front of it for logs.
+func (h JumpHostConfig) String() string {
+	name := fmt.Sprintf("%s@%s:%d", h.Username, h.Host, h.port())
+	if h.JumpHost != nil {
+		name += " via " + h.JumpHost.String()
+	}
+	return name
+}
+
+// key identifies a bastion connection. Routers share it only when they
+// also agree on the host keys it was verified with.
+func (h JumpHostConfig) key() string {
+	key := h.String()
+	if len(h.HostKeyFingerprints) > 0 {
+		key += " " + strings.Join(h.HostKeyFingerprints, ",")
+	}
+	return key
+}
+
+func (h JumpHostConfig) port() int {
+	if h.Port > 0 {
+		return h.Port
+	}
+	return 22
+}
+
+// router describes the jump host as a router, so it is dialed with the same
+// authentication, host key and algorithm handling.
+func (h JumpHostConfig) router(timeout time.Duration) RouterConfig {
+	return RouterConfig{
+		Name:                "jump host " + h.Host,
+		HostKeyFingerprints: h.HostKeyFingerprints,
+		SSHProfile:          h.SSHProfile,
+		Connection: ConnectionConfig{
+			Type:           "ssh",
+			Host:           h.Host,
+			Port:           h.port(),
+			Username:       h.Username,
+			Password:       h.Password,
+			PrivateKeyFile: h.PrivateKeyFile,
+			Passphrase:     h.Passphrase,
+			AgentSocket:    h.AgentSocket,
+			AuthOrder:      h.AuthOrder,
+			Timeout:        int(timeout / time.Millisecond),
+			JumpHost:       h.JumpHost,
+		},
+	}
+}
+
+// checkJumpHosts rejects jump host chains that cannot work: a hop without
+// a host, or one leading back to the router or to a hop already on the path.
+func checkJumpHosts(router RouterConfig) error {
+	port := router.Connection.Port
+	if port == 0 {
+		port = 22
+	}
+	seen := map[string]bool{net.JoinHostPort(router.Connection.Host, strconv.Itoa(port)): true}
+
+	for hop := router.Connection.JumpHost; hop != nil; hop = hop.JumpHost {
+		if hop.Host == "" {
+			return fmt.Errorf("router %s: jump host without a host", router.Name)
+		}
+		addr := net.JoinHostPort(hop.Host, strconv.Itoa(hop.port()))
+		if seen[addr] {
+			return fmt.Errorf("router %s: jump host %s is already on the path", router.Name, addr)
+		}
+		seen[addr] = true
+	}
+	return nil
+}
+
+// jumpHosts shares bastion connections between all the routers behind
+// them. A bastion connection is closed once no router connection uses it.
+var jumpHosts = &jumpHostPool{conns: make(map[string]*jumpConn)}
+
+type jumpHostPool struct {
+	mu    sync.Mutex
+	conns map[string]*jumpConn
+}
+
+type jumpConn struct {
+	ready  chan struct{} // closed once dialing is done
+	client *ssh.Client
+	err    error
+	refs   int
+}
+
+// acquire returns a connection to the jump host, dialing it unless another
+// router already has one. The release function must be called once the
+// connection is no longer used.
+func (p *jumpHostPool) acquire(hop JumpHostConfig, timeout time.Duration) (*ssh.Client, func(), error) {
+	key := hop.key()
+
+	p.mu.Lock()
+	jc, ok := p.conns[key]
+	if !ok {
+		jc = &jumpConn{ready: make(chan struct{})}
+		p.conns[key] = jc
+	}
+	jc.refs++
+	p.mu.Unlock()
+
+	// Requests arriving while the bastion is being dialed wait for it
+	if !ok {
+		jc.client, jc.err = dialSSH(hop.router(timeout))
+		if jc.err == nil {
+			go p.watch(key, jc)
+		}
+		close(jc.ready)
+	}
+	<-jc.ready
+
+	if jc.err != nil {
+		p.release(key, jc)
+		return nil, nil, jc.err
+	}
+	return jc.client, func() { p.release(key, jc) }, nil
+}
+
+func (p *jumpHostPool) release(key string, jc *jumpConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	jc.refs--
+	if jc.refs > 0 {
+		return
+	}
+	if p.conns[key] == jc {
+		delete(p.conns, key)
+	}
+	if jc.client != nil {
+		jc.client.Close()
+	}
+}
+
+// watch forgets a bastion connection as soon as it is closed, so the next
+// request dials a new one.
+func (p *jumpHostPool) watch(key string, jc *jumpConn) {
+	err := jc.client.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns[key] == jc {
+		delete(p.conns, key)
+		log.Printf("SSH connection to jump host %s closed: %v", key, err)
+	}
+}
+
+// dialSSHVia opens an SSH connection to addr tunneled through the jump host.
+func dialSSHVia(hop JumpHostConfig, addr string, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	bastion, release, err := jumpHosts.acquire(hop, sshConfig.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("jump host %s: %w", hop.Host, err)
+	}
+
+	conn, err := bastion.Dial("tcp", addr)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("jump host %s cannot reach %s: %w", hop.Host, addr, err)
+	}
+
+	// Tunneled connections have no deadlines, so bound the handshake here
+	timer := time.AfterFunc(sshConfig.Timeout, func() { conn.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+	if !timer.Stop() && err != nil {
+		err = fmt.Errorf("handshake timeout after %s", sshConfig.Timeout)
+	}
+	if err != nil {
+		conn.Close()
+		release()
+		return nil, err
+	}
+
+	client := ssh.NewClient(c, chans, reqs)
+	go func() {
+		client.Wait()
+		release()
+	}()
+	return client, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// bastion is an SSH server forwarding direct-tcpip channels, recording the
+// logins and the addresses it was asked to reach.
+type bastion struct {
+	logins atomic.Int32
+	mu     sync.Mutex
+	dialed []string
+}
+
+func (b *bastion) targets() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.dialed...)
+}
+
+// startBastion runs a bastion accepting password "secret" and returns it
+// as a jump host in front of next.
+func startBastion(t *testing.T, next *JumpHostConfig) (JumpHostConfig, *bastion) {
+	t.Helper()
+
+	b := &bastion{}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "secret" {
+				return nil, errors.New("wrong password")
+			}
+			b.logins.Add(1)
+			return nil, nil
+		},
+	}
+	router, _ := serveTestSSHWith(t, config, func(chans <-chan ssh.NewChannel) {
+		for newChannel := range chans {
+			if newChannel.ChannelType() != "direct-tcpip" {
+				newChannel.Reject(ssh.UnknownChannelType, "only forwarding")
+				continue
+			}
+			var target struct {
+				Host     string
+				Port     uint32
+				OrigHost string
+				OrigPort uint32
+			}
+			if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+				newChannel.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			addr := net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port)))
+			b.mu.Lock()
+			b.dialed = append(b.dialed, addr)
+			b.mu.Unlock()
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				newChannel.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go ssh.DiscardRequests(requests)
+			go func() {
+				io.Copy(conn, channel)
+				conn.Close()
+			}()
+			go func() {
+				io.Copy(channel, conn)
+				channel.Close()
+			}()
+		}
+	})
+
+	return JumpHostConfig{
+		Host:                router.Connection.Host,
+		Port:                router.Connection.Port,
+		Username:            "lg",
+		Password:            "secret",
+		HostKeyFingerprints: router.HostKeyFingerprints,
+		JumpHost:            next,
+	}, b
+}
+
+func TestJumpHostChain(t *testing.T) {
+	gateway, gatewayStub := startBastion(t, nil)
+	inner, innerStub := startBastion(t, &gateway)
+
+	router1, logins1 := startTestSSHServer(t)
+	router1.Connection.JumpHost = &inner
+	router2, logins2 := startTestSSHServer(t)
+	router2.Connection.JumpHost = &inner
+	if err := checkJumpHosts(router1); err != nil {
+		t.Fatal(err)
+	}
+
+	client1, err := dialSSH(router1)
+	if err != nil {
+		t.Fatalf("dial through two jump hosts failed: %v", err)
+	}
+	defer client1.Close()
+	client2, err := dialSSH(router2)
+	if err != nil {
+		t.Fatalf("second router failed: %v", err)
+	}
+	defer client2.Close()
+
+	if logins1.Load() != 1 || logins2.Load() != 1 {
+		t.Errorf("router logins = %d and %d, want 1 each", logins1.Load(), logins2.Load())
+	}
+	// Each hop reaches the next one, and the routers share the bastions
+	if got, want := gatewayStub.targets(), []string{net.JoinHostPort(inner.Host, strconv.Itoa(inner.Port))}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("gateway forwarded to %v, want %v", got, want)
+	}
+	if got, want := innerStub.targets(), []string{routerAddr(router1), routerAddr(router2)}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("bastion forwarded to %v, want %v", got, want)
+	}
+	if gatewayStub.logins.Load() != 1 || innerStub.logins.Load() != 1 {
+		t.Errorf("jump host logins = %d and %d, want one shared connection each",
+			gatewayStub.logins.Load(), innerStub.logins.Load())
+	}
+
+	// The bastion connections go once no router needs them
+	client1.Close()
+	client2.Close()
+	for i := 0; ; i++ {
+		jumpHosts.mu.Lock()
+		_, open := jumpHosts.conns[inner.key()]
+		jumpHosts.mu.Unlock()
+		if !open {
+			break
+		}
+		if i == 100 {
+			t.Fatal("bastion connection kept after the routers closed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestJumpHostUnreachable(t *testing.T) {
+	router, _ := startTestSSHServer(t)
+	router.Connection.JumpHost = &JumpHostConfig{Host: "127.0.0.1", Port: freeTCPPort(t), Username: "lg", Password: "secret"}
+	router.Connection.Timeout = 2000
+
+	client, err := dialSSH(router)
+	if err == nil {
+		client.Close()
+		t.Fatal("dial through a jump host nobody listens on succeeded")
+	}
+	if !strings.HasPrefix(err.Error(), "jump host 127.0.0.1: ") {
+		t.Errorf("got %v, want a jump host error", err)
+	}
+	jumpHosts.mu.Lock()
+	_, kept := jumpHosts.conns[router.Connection.JumpHost.key()]
+	jumpHosts.mu.Unlock()
+	if kept {
+		t.Error("failed jump host connection kept in the pool")
+	}
+
+	// A bastion that cannot reach the router
+	bastion, _ := startBastion(t, nil)
+	router.Connection.JumpHost = &bastion
+	router.Connection.Port = freeTCPPort(t)
+	if client, err := dialSSH(router); err == nil {
+		client.Close()
+		t.Fatal("dial to a closed router port succeeded")
+	} else if !strings.Contains(err.Error(), "cannot reach "+routerAddr(router)) {
+		t.Errorf("got %v, want a cannot reach error", err)
+	}
+}
+
+func TestCheckJumpHosts(t *testing.T) {
+	router := func(hop *JumpHostConfig) RouterConfig {
+		return RouterConfig{Name: "r1", Connection: ConnectionConfig{Host: "10.0.0.1", JumpHost: hop}}
+	}
+	gateway := &JumpHostConfig{Host: "gateway.example.net"}
+	cycle := &JumpHostConfig{Host: "a.example.net"}
+	cycle.JumpHost = &JumpHostConfig{Host: "b.example.net", JumpHost: cycle}
+
+	tests := []struct {
+		name   string
+		router RouterConfig
+		err    string
+	}{
+		{"direct", router(nil), ""},
+		{"two hops", router(&JumpHostConfig{Host: "bastion.example.net", JumpHost: gateway}), ""},
+		{"same host on another port", router(&JumpHostConfig{Host: "10.0.0.1", Port: 2222}), ""},
+		{"missing host", router(&JumpHostConfig{Host: "bastion.example.net", JumpHost: &JumpHostConfig{Username: "lg"}}), "router r1: jump host without a host"},
+		{"through the router", router(&JumpHostConfig{Host: "10.0.0.1", Port: 22}), "router r1: jump host 10.0.0.1:22 is already on the path"},
+		{"hop twice", router(&JumpHostConfig{Host: "gateway.example.net", JumpHost: gateway}), "router r1: jump host gateway.example.net:22 is already on the path"},
+		{"cycle", router(cycle), "router r1: jump host a.example.net:22 is already on the path"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkJumpHosts(tt.router)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("got %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
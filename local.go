@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Programs the local connection type may run, with the arguments that must
+// follow the program name (after any -4/-6 flag) for it to be accepted
+var localCommands = map[string][]string{
+	"ping":       nil,
+	"traceroute": nil,
+	"mtr":        nil,
+	"ip":         {"route", "get"},
+}
+
+// localArgv checks command against localCommands and returns the argv to
+// run for it.
+func localArgv(command string) ([]string, error) {
+	argv := strings.Fields(command)
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+
+	required, ok := localCommands[argv[0]]
+	if !ok {
+		return nil, fmt.Errorf("command %q is not allowed on local routers", argv[0])
+	}
+	args := argv[1:]
+	if len(args) > 0 && (args[0] == "-4" || args[0] == "-6") {
+		args = args[1:]
+	}
+	if len(args) < len(required) || strings.Join(args[:len(required)], " ") != strings.Join(required, " ") {
+		return nil, fmt.Errorf("command %q is not allowed on local routers", command)
+	}
+
+	// ip route get only takes an address: a prefix from the BGP route query
+	// is looked up by its network address
+	if argv[0] == "ip" && len(args) == len(required)+1 {
+		if prefix, err := netip.ParsePrefix(args[len(required)]); err == nil {
+			argv[len(argv)-1] = prefix.Addr().String()
+		}
+	}
+	return argv, nil
+}
+
+// runLocalCommand is the commandRunner for connection type "local": the
+// command is run on the Looking Glass host itself, as an argv without a
+// shell. Only the programs in localCommands are allowed.
+func runLocalCommand(router RouterConfig, command string, timeout time.Duration, emit func(line string)) (any, error) {
+	argv, err := localArgv(command)
+	if err != nil {
+		return nil, err
+	}
+	if argv[0] != "mtr" {
+		return nil, runProcess(argv, timeout, emit)
+	}
+
+	// mtr --json prints its report once all cycles are done: it is
+	// returned as the structured result, pretty-printed for display
+	var lines []string
+	err = runProcess(argv, timeout, func(line string) {
+		lines = append(lines, line)
+	})
+	output, data := structuredOutput(strings.Join(lines, "\n"))
+	for _, line := range strings.Split(output, "\n") {
+		emit(line)
+	}
+	if data == nil {
+		return nil, err
+	}
+	return data, err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalArgv(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string // argv joined by spaces, empty when rejected
+	}{
+		{"ping -4 -c 5 192.0.2.1", "ping -4 -c 5 192.0.2.1"},
+		{"mtr -6 --json -c 5 example.com", "mtr -6 --json -c 5 example.com"},
+		{"ip -4 route get 192.0.2.1", "ip -4 route get 192.0.2.1"},
+		{"ip -4 route get 192.0.2.0/24", "ip -4 route get 192.0.2.0"},
+		{"ip -6 route get 2001:db8::/32", "ip -6 route get 2001:db8::"},
+		{"ip -4 route get 192.0.2.1/32", "ip -4 route get 192.0.2.1"},
+		{"ip route flush all", ""},
+		{"ip -4 route", ""},
+		{"sh -c reboot", ""},
+		{"  ", ""},
+	}
+
+	for _, tt := range tests {
+		argv, err := localArgv(tt.command)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("localArgv(%q) = %q, want an error", tt.command, argv)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("localArgv(%q) failed: %v", tt.command, err)
+			continue
+		}
+		if got := strings.Join(argv, " "); got != tt.want {
+			t.Errorf("localArgv(%q) = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestLocalMtrReport(t *testing.T) {
+	// A stand-in mtr printing a report the way mtr --json does
+	dir := t.TempDir()
+	script := "#!/bin/sh\nprintf '{\\n  \"report\": {\\n    \"mtr\": {\"dst\": \"%s\", \"tests\": 5},\\n    \"hubs\": [{\"count\": 1, \"host\": \"192.0.2.1\", \"Loss%%\": 0.0}]\\n  }\\n}\\n' \"$5\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "mtr"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	var lines []string
+	result, err := runLocalCommand(RouterConfig{Name: "lg-host"}, "mtr -4 --json -c 5 192.0.2.1", 5*time.Second, func(line string) {
+		lines = append(lines, line)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, ok := result.(json.RawMessage)
+	if !ok {
+		t.Fatalf("result = %#v, want the JSON report", result)
+	}
+	var report struct {
+		Report struct {
+			Mtr  struct{ Dst string }
+			Hubs []struct{ Host string }
+		}
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Report.Mtr.Dst != "192.0.2.1" || len(report.Report.Hubs) != 1 || report.Report.Hubs[0].Host != "192.0.2.1" {
+		t.Errorf("report = %+v", report)
+	}
+	if len(lines) < 2 || lines[0] != "{" {
+		t.Errorf("output = %q, want the pretty-printed report", lines)
+	}
+
+	// Anything else than JSON is shown as it is, without a result
+	if err := os.WriteFile(filepath.Join(dir, "mtr"), []byte("#!/bin/sh\necho 'mtr: Name or service not known'\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	lines = nil
+	result, err = runLocalCommand(RouterConfig{Name: "lg-host"}, "mtr -4 --json -c 5 bogus.invalid", 5*time.Second, func(line string) {
+		lines = append(lines, line)
+	})
+	if err != nil || result != nil {
+		t.Fatalf("got %v, %v, want no result and no error", result, err)
+	}
+	if len(lines) != 1 || lines[0] != "mtr: Name or service not known" {
+		t.Errorf("output = %q", lines)
+	}
+}
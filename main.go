@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,13 +13,13 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/time/rate"
 )
 
 // Configuration structures
@@ -28,7 +29,18 @@ type Config struct {
 	LogFile   string          `json:"logFile"`
 	Timeout   int             `json:"timeout"`
 	Routers   []RouterConfig  `json:"routers"`
-	Security  SecurityConfig  `json:"security"`
+
+	// Optional JSON file replacing the built-in query/command definitions
+	CommandsFile string `json:"commandsFile"`
+
+	Security SecurityConfig `json:"security"`
+	SSH      SSHConfig      `json:"ssh"`
+	Agent    AgentConfig    `json:"agent"`
+
+	// Output filter rules per OS type, "*" for every router
+	OutputFilters map[string][]OutputFilter `json:"outputFilters"`
+
+	Redaction RedactionConfig `json:"redaction"`
 }
 
 type AppConfig struct {
@@ -40,9 +52,13 @@ type AppConfig struct {
 }
 
 type RecaptchaConfig struct {
-	Enabled   bool   `json:"enabled"`
-	SiteKey   string `json:"siteKey"`
-	SecretKey string `json:"secretKey"`
+	Enabled   bool    `json:"enabled"`
+	Provider  string  `json:"provider"` // recaptcha (default), hcaptcha or turnstile
+	SiteKey   string  `json:"siteKey"`
+	SecretKey string  `json:"secretKey"`
+	VerifyURL string  `json:"verifyUrl"`
+	MinScore  float64 `json:"minScore"`
+	Action    string  `json:"action"`
 }
 
 type RouterConfig struct {
@@ -53,24 +69,77 @@ type RouterConfig struct {
 	IPv4Enabled bool             `json:"ipv4Enabled"`
 	IPv6Enabled bool             `json:"ipv6Enabled"`
 	Connection  ConnectionConfig `json:"connection"`
+
+	// SHA256:... (or legacy MD5) fingerprints accepted for this router
+	HostKeyFingerprints []string `json:"hostKeyFingerprints"`
+
+	// Commands allowed to run at once (0 = unlimited) and how long extra
+	// requests may wait in the queue
+	MaxConcurrent  int `json:"maxConcurrent"`
+	QueueTimeoutMs int `json:"queueTimeoutMs"`
+
+	// modern (default), legacy or custom; custom reads SSHAlgorithms
+	SSHProfile    string              `json:"sshProfile"`
+	SSHAlgorithms SSHAlgorithmsConfig `json:"sshAlgorithms"`
+
+	// exec (default) or shell, for routers that refuse SSH exec requests
+	ExecMode string `json:"execMode"`
+	// Regex of the CLI prompt, replacing the one of the OS
+	Prompt       string `json:"prompt"`
+	prompt       *regexp.Regexp
+	promptPrefix *regexp.Regexp
+
+	OutputFilters []OutputFilter `json:"outputFilters"`
 }
 
 type ConnectionConfig struct {
-	Type     string `json:"type"`
-	Host     string `json:"host"`
-	Port     int    `json:"port"`
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Timeout  int    `json:"timeout"`
+	Type           string   `json:"type"`
+	Host           string   `json:"host"`
+	Port           int      `json:"port"`
+	Username       string   `json:"username"`
+	Password       string   `json:"password"`
+	PrivateKeyFile string   `json:"privateKeyFile"`
+	Passphrase     string   `json:"passphrase"`
+	AgentSocket    string   `json:"agentSocket"`
+	AuthOrder      []string `json:"authOrder"`
+	Timeout        int      `json:"timeout"`
+	PoolSize       int      `json:"poolSize"`    // pooled connections, -1 disables pooling
+	MaxSessions    int      `json:"maxSessions"` // concurrent sessions per pooled connection
+	Socket         string   `json:"socket"`      // control socket for type "bird"
+	Binary         string   `json:"binary"`      // local CLI for types "vtysh" and "bgpctl"
+	CACertFile     string   `json:"caCertFile"`  // PEM CA or certificate trusted for HTTPS APIs
+	TLS            bool     `json:"tls"`         // TLS for type "routeros" (api-ssl)
+	URL            string   `json:"url"`         // agent base URL for type "agent"
+	RemoteRouter   string   `json:"remoteRouter"`
+	CertFile       string   `json:"certFile"` // client certificate for mutual TLS
+	KeyFile        string   `json:"keyFile"`
+	HMACSecret     string   `json:"hmacSecret"`
+
+	// SSH bastion the router is reached through
+	JumpHost *JumpHostConfig `json:"jumpHost"`
+}
+
+type SSHConfig struct {
+	KnownHostsFile  string `json:"knownHostsFile"`
+	TrustOnFirstUse bool   `json:"trustOnFirstUse"`
+	KeepaliveMs     int    `json:"keepaliveMs"`
+	IdleTimeoutMs   int    `json:"idleTimeoutMs"`
 }
 
 type SecurityConfig struct {
 	RateLimit      RateLimitConfig `json:"rateLimit"`
 	SecureMode     bool            `json:"secureMode"`
 	AllowedOrigins []string        `json:"allowedOrigins"`
+	TrustedProxies []string        `json:"trustedProxies"`
 }
 
 type RateLimitConfig struct {
+	RateLimitRule
+	MaxClients int                      `json:"maxClients"`
+	Queries    map[string]RateLimitRule `json:"queries"` // stricter limits per query type
+}
+
+type RateLimitRule struct {
 	WindowMs int `json:"windowMs"`
 	Max      int `json:"max"`
 }
@@ -85,130 +154,62 @@ type ExecuteRequest struct {
 }
 
 type ExecuteResponse struct {
-	Success   bool   `json:"success"`
-	Router    string `json:"router"`
-	Command   string `json:"command"`
-	Output    string `json:"output"`
-	Timestamp string `json:"timestamp"`
+	Success   bool            `json:"success"`
+	Router    string          `json:"router"`
+	Command   string          `json:"command"`
+	Output    string          `json:"output"`
+	Data      json.RawMessage `json:"data,omitempty"` // structured result, when available
+	Timestamp string          `json:"timestamp"`
 }
 
 type RouterInfo struct {
-	Value       string `json:"value"`
-	Text        string `json:"text"`
-	Location    string `json:"location"`
-	IPv4Enabled bool   `json:"ipv4Enabled"`
-	IPv6Enabled bool   `json:"ipv6Enabled"`
+	Value       string   `json:"value"`
+	Text        string   `json:"text"`
+	Location    string   `json:"location"`
+	IPv4Enabled bool     `json:"ipv4Enabled"`
+	IPv6Enabled bool     `json:"ipv6Enabled"`
+	Queries     []string `json:"queries"`
 }
 
 type ErrorResponse struct {
 	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
 }
 
 // NEW: Streaming response structure
 type StreamResponse struct {
-	Type    string `json:"type"`
-	Data    string `json:"data,omitempty"`
-	Error   string `json:"error,omitempty"`
-	Command string `json:"command,omitempty"`
-	Router  string `json:"router,omitempty"`
+	Type     string          `json:"type"`
+	Data     string          `json:"data,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Command  string          `json:"command,omitempty"`
+	Router   string          `json:"router,omitempty"`
+	Position int             `json:"position,omitempty"` // queue position for "queued" events
+	Result   json.RawMessage `json:"result,omitempty"`   // structured result on "complete"
 }
 
 // Global variables
 var (
-	config      Config
-	rateLimiter *rate.Limiter
-	logMutex    sync.Mutex
+	config        Config
+	clientLimiter *keyedLimiter
+	queryLimiters map[string]*keyedLimiter
+	logMutex      sync.Mutex
 )
 
-// Helper function per saltare righe inutili
-func shouldSkipLine(line string) bool {
-	return strings.HasSuffix(line, "@juno01>") ||
-		strings.HasSuffix(line, "@juno01-mx204>") ||
-		strings.HasSuffix(line, "ellegi@juno01>") ||
-		strings.HasSuffix(line, "kappa@juno01-mx204>") ||
-		strings.HasSuffix(line, "netengine01>") ||
-		strings.HasPrefix(line, "<netengine01") ||
-		strings.Contains(line, "Info: The max number of VTY users") ||
-		strings.Contains(line, "The current login time is") ||
-		strings.Contains(line, "The last login time is") ||
-		strings.Contains(line, "through SSH") ||
-		strings.Contains(line, "from 2A02:4460:1:1::19 through SSH") ||
-		strings.Contains(line, "and the number of current VTY users on line is")
-}
-
 // NEW: Funzione per streaming SSH con output in tempo reale
-func executeSSHCommandStreaming(host string, port int, username, password, command string, w http.ResponseWriter) {
-	// Set headers per streaming
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
-		return
-	}
+func executeSSHCommandStreaming(router RouterConfig, command string, sendData func(StreamResponse)) {
+	command = withExecFormat(router, command)
 
-	// Funzione helper per inviare dati
-	sendData := func(resp StreamResponse) {
-		data, _ := json.Marshal(resp)
-		fmt.Fprintf(w, "%s\n", data)
-		flusher.Flush()
-	}
-
-	sshConfig := &ssh.ClientConfig{
-		User: username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(password),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         20 * time.Second,
-		Config: ssh.Config{
-			KeyExchanges: []string{
-				"diffie-hellman-group-exchange-sha256",
-				"diffie-hellman-group-exchange-sha1",
-				"diffie-hellman-group14-sha256",
-				"diffie-hellman-group14-sha1",
-				"diffie-hellman-group1-sha1",
-				"curve25519-sha256",
-				"curve25519-sha256@libssh.org",
-				"ecdh-sha2-nistp256",
-				"ecdh-sha2-nistp384",
-				"ecdh-sha2-nistp521",
-			},
-			Ciphers: []string{
-				"aes128-ctr", "aes192-ctr", "aes256-ctr",
-				"aes128-cbc", "aes192-cbc", "aes256-cbc",
-				"3des-cbc", "blowfish-cbc", "cast128-cbc",
-				"arcfour256", "arcfour128", "arcfour",
-			},
-			MACs: []string{
-				"hmac-sha2-256", "hmac-sha2-512", "hmac-sha1",
-				"hmac-sha1-96", "hmac-md5", "hmac-md5-96", "hmac-ripemd160",
-			},
-		},
-	}
-
-	addr := fmt.Sprintf("%s:%d", host, port)
-	log.Printf("Connecting to %s for streaming...", addr)
+	filter := outputFilterFor(router)
 
 	// Invia messaggio di inizio
 	sendData(StreamResponse{Type: "start", Command: command})
 
-	conn, err := ssh.Dial("tcp", addr, sshConfig)
-	if err != nil {
-		sendData(StreamResponse{Type: "error", Error: fmt.Sprintf("SSH connection failed: %v", err)})
-		return
-	}
-	defer conn.Close()
-
-	session, err := conn.NewSession()
+	session, release, err := sshConnPool.newSession(router)
 	if err != nil {
-		sendData(StreamResponse{Type: "error", Error: fmt.Sprintf("SSH session failed: %v", err)})
+		sendData(StreamResponse{Type: "error", Error: sshErrorMessage(err)})
 		return
 	}
-	defer session.Close()
+	defer release()
 
 	// Setup pipes per lettura real-time
 	stdout, err := session.StdoutPipe()
@@ -237,8 +238,7 @@ func executeSSHCommandStreaming(host string, port int, username, password, comma
 		defer func() { done <- true }()
 		scanner := bufio.NewScanner(stdout)
 		for scanner.Scan() {
-			line := strings.TrimSpace(scanner.Text())
-			if line != "" && !shouldSkipLine(line) {
+			if line, ok := filter.apply(scanner.Text()); ok {
 				sendData(StreamResponse{Type: "data", Data: line})
 			}
 		}
@@ -249,8 +249,7 @@ func executeSSHCommandStreaming(host string, port int, username, password, comma
 		defer func() { done <- true }()
 		scanner := bufio.NewScanner(stderr)
 		for scanner.Scan() {
-			line := strings.TrimSpace(scanner.Text())
-			if line != "" && !shouldSkipLine(line) {
+			if line, ok := filter.apply(scanner.Text()); ok {
 				sendData(StreamResponse{Type: "data", Data: line})
 			}
 		}
@@ -282,74 +281,17 @@ func executeSSHCommandStreaming(host string, port int, username, password, comma
 }
 
 // SSH Client with improved router detection and command execution (ORIGINAL)
-func executeSSHCommand(host string, port int, username, password, command string) (string, error) {
-	sshConfig := &ssh.ClientConfig{
-		User: username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(password),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         20 * time.Second,
-		Config: ssh.Config{
-			KeyExchanges: []string{
-				"diffie-hellman-group-exchange-sha256",
-				"diffie-hellman-group-exchange-sha1",
-				"diffie-hellman-group14-sha256",
-				"diffie-hellman-group14-sha1",
-				"diffie-hellman-group1-sha1",
-				"curve25519-sha256",
-				"curve25519-sha256@libssh.org",
-				"ecdh-sha2-nistp256",
-				"ecdh-sha2-nistp384",
-				"ecdh-sha2-nistp521",
-			},
-			Ciphers: []string{
-				"aes128-ctr",
-				"aes192-ctr",
-				"aes256-ctr",
-				"aes128-cbc",
-				"aes192-cbc",
-				"aes256-cbc",
-				"3des-cbc",
-				"blowfish-cbc",
-				"cast128-cbc",
-				"arcfour256",
-				"arcfour128",
-				"arcfour",
-			},
-			MACs: []string{
-				"hmac-sha2-256",
-				"hmac-sha2-512",
-				"hmac-sha1",
-				"hmac-sha1-96",
-				"hmac-md5",
-				"hmac-md5-96",
-				"hmac-ripemd160",
-			},
-		},
-	}
-
-	addr := fmt.Sprintf("%s:%d", host, port)
-	log.Printf("Connecting to %s with legacy SSH algorithms...", addr)
-
-	conn, err := ssh.Dial("tcp", addr, sshConfig)
-	if err != nil {
-		return "", fmt.Errorf("SSH connection failed: %v", err)
-	}
-	defer conn.Close()
+func executeSSHCommand(router RouterConfig, command string) (string, error) {
+	filter := outputFilterFor(router)
 
-	log.Printf("SSH connected successfully to %s", host)
-
-	session, err := conn.NewSession()
+	session, release, err := sshConnPool.newSession(router)
 	if err != nil {
-		return "", fmt.Errorf("SSH session failed: %v", err)
+		return "", errors.New(sshErrorMessage(err))
 	}
-	defer session.Close()
+	defer release()
 
-	// Gestione paging migliorata per entrambi i router types
-	if !strings.Contains(command, "ping") && !strings.Contains(command, "trace") {
-		command = command + " | no-more"
-	}
+	// Disabilita il paging secondo il sistema operativo del router
+	command = withExecFormat(router, withPagerSuffix(router, command))
 
 	log.Printf("Executing command: %s", command)
 
@@ -367,28 +309,28 @@ func executeSSHCommand(host string, port int, username, password, command string
 			log.Printf("Command error: %v", err)
 			if len(output) > 0 {
 				log.Printf("Returning partial output despite error")
-				return cleanSSHOutput(string(output), host), nil
+				return cleanSSHOutput(string(output), filter), nil
 			}
 			return "", fmt.Errorf("command failed: %v", err)
 		}
 		log.Printf("Command completed successfully, %d bytes output", len(output))
 		rawOutput := string(output)
 		log.Printf("Raw output first 200 chars: %q", rawOutput[:min(200, len(rawOutput))])
-		cleaned := cleanSSHOutput(rawOutput, host)
+		cleaned := cleanSSHOutput(rawOutput, filter)
 		log.Printf("Cleaned output first 200 chars: %q", cleaned[:min(200, len(cleaned))])
 		return cleaned, nil
 	case <-time.After(60 * time.Second):
 		log.Printf("Command timeout after 60 seconds")
 		session.Close()
 		if len(output) > 0 {
-			return cleanSSHOutput(string(output), host), nil
+			return cleanSSHOutput(string(output), filter), nil
 		}
 		return "", fmt.Errorf("command timeout")
 	}
 }
 
 // ULTRA minimal cleaning - only ANSI codes and line endings
-func cleanSSHOutput(output string, host string) string {
+func cleanSSHOutput(output string, filter lineFilter) string {
 	// Remove ANSI escape sequences
 	ansiRegex := regexp.MustCompile(`\x1b\[[0-9;]*[a-zA-Z]`)
 	cleaned := ansiRegex.ReplaceAllString(output, "")
@@ -401,104 +343,22 @@ func cleanSSHOutput(output string, host string) string {
 	var result []string
 
 	for _, line := range lines {
-		// Keep original line, just trim whitespace
-		line = strings.TrimSpace(line)
-
-		// Skip ONLY these very specific patterns:
-		if line == "" ||
-			strings.HasSuffix(line, "@juno01>") ||
-			strings.HasSuffix(line, "@juno01-mx204>") ||
-			strings.HasSuffix(line, "ellegi@juno01>") ||
-			strings.HasSuffix(line, "kappa@juno01-mx204>") ||
-			strings.HasSuffix(line, "netengine01>") ||
-			strings.HasPrefix(line, "<netengine01") ||
-			strings.Contains(line, "Info: The max number of VTY users") ||
-			strings.Contains(line, "The current login time is") ||
-			strings.Contains(line, "The last login time is") ||
-			strings.Contains(line, "through SSH") ||
-			strings.Contains(line, "from 2A02:4460:1:1::19 through SSH") ||
-			strings.Contains(line, "and the number of current VTY users on line is") {
-			continue
+		if line, ok := filter.apply(line); ok {
+			result = append(result, line)
 		}
-
-		result = append(result, line)
 	}
 
 	return strings.TrimSpace(strings.Join(result, "\n"))
 }
 
-// Corrected command generation with proper Junos syntax
-func generateCommand(query, protocol, addr string, routerConfig RouterConfig) (string, error) {
-	isIPv6 := protocol == "IPv6"
-
-	switch routerConfig.OSType {
-	case "huawei":
-		switch query {
-		case "bgp":
-			if isIPv6 {
-				return fmt.Sprintf("display bgp ipv6 routing-table %s", addr), nil
-			}
-			return fmt.Sprintf("display bgp routing-table %s", addr), nil
-		case "advertised-routes":
-			if isIPv6 {
-				return fmt.Sprintf("display bgp ipv6 routing-table peer %s advertised-routes", addr), nil
-			}
-			return fmt.Sprintf("display bgp routing-table peer %s advertised-routes", addr), nil
-		case "unicast neighbors":
-			if isIPv6 {
-				return "display bgp ipv6 peer verbose", nil
-			}
-			return "display bgp peer verbose", nil
-		case "summary":
-			if isIPv6 {
-				return "display bgp ipv6 peer", nil
-			}
-			return "display bgp peer", nil
-		case "ping":
-			if isIPv6 {
-				return fmt.Sprintf("ping ipv6 %s", addr), nil
-			}
-			return fmt.Sprintf("ping %s", addr), nil
-		case "trace":
-			if isIPv6 {
-				return fmt.Sprintf("tracert ipv6 %s", addr), nil
-			}
-			return fmt.Sprintf("tracert %s", addr), nil
-		}
-
-	case "junos":
-		switch query {
-		case "bgp":
-			// CORRECTED: Use show route X instead of show route protocol bgp X
-			return fmt.Sprintf("show route %s", addr), nil
-		case "advertised-routes":
-			// Advertised routes command correct as is
-			return fmt.Sprintf("show route advertising-protocol bgp %s", addr), nil
-		case "unicast neighbors":
-			return "show bgp neighbor", nil
-		case "summary":
-			return "show bgp summary", nil
-		case "ping":
-			return fmt.Sprintf("ping count 5 %s", addr), nil
-		case "trace":
-			if isIPv6 {
-				return fmt.Sprintf("traceroute %s", addr), nil
-			}
-			return fmt.Sprintf("traceroute %s as-number-lookup", addr), nil
-		}
-	}
-
-	return "", fmt.Errorf("unsupported query type or router OS")
-}
-
 // Logging
-func logCommand(ip, router, command string, success bool) {
+func logCommand(ip, router, command string, success, redacted bool) {
 	logMutex.Lock()
 	defer logMutex.Unlock()
 
 	timestamp := time.Now().Format(time.RFC3339)
-	logEntry := fmt.Sprintf("%s - IP: %s - Router: %s - Command: %s - Success: %t\n",
-		timestamp, ip, router, command, success)
+	logEntry := fmt.Sprintf("%s - IP: %s - Router: %s - Command: %s - Success: %t - Redacted: %t\n",
+		timestamp, ip, router, command, success, redacted)
 
 	log.Print(strings.TrimSpace(logEntry))
 
@@ -515,10 +375,7 @@ func logCommand(ip, router, command string, success bool) {
 
 func rateLimitMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if !rateLimiter.Allow() {
-			c.JSON(http.StatusTooManyRequests, ErrorResponse{
-				Error: "Too many requests, please try again later.",
-			})
+		if !applyRateLimit(c, clientLimiter) {
 			c.Abort()
 			return
 		}
@@ -534,11 +391,24 @@ func loadConfig() error {
 	defer file.Close()
 
 	decoder := json.NewDecoder(file)
-	return decoder.Decode(&config)
-}
-
-func verifyRecaptcha(token string) (bool, error) {
-	return !config.Recaptcha.Enabled || token != "", nil
+	if err := decoder.Decode(&config); err != nil {
+		return err
+	}
+	for _, router := range config.Routers {
+		if t := router.Connection.Timeout; t > 0 && t < 1000 {
+			log.Printf("Warning: router %s has connection.timeout %d, which is in milliseconds", router.Name, t)
+		}
+		if err := checkJumpHosts(router); err != nil {
+			return err
+		}
+	}
+	if err := compileRouterPrompts(); err != nil {
+		return err
+	}
+	if err := compileOutputFilters(); err != nil {
+		return err
+	}
+	return compileRedaction()
 }
 
 // API Handlers
@@ -551,6 +421,7 @@ func getRoutersHandler(c *gin.Context) {
 			Location:    router.Location,
 			IPv4Enabled: router.IPv4Enabled,
 			IPv6Enabled: router.IPv6Enabled,
+			Queries:     supportedQueries(router),
 		}
 	}
 	c.JSON(http.StatusOK, routers)
@@ -567,18 +438,26 @@ func executeStreamingHandler(c *gin.Context) {
 	clientIP := c.ClientIP()
 
 	// Validazione
-	needsAddress := !contains([]string{"summary", "unicast neighbors"}, req.Query)
-	if needsAddress && req.Addr == "" {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Address is required for this query type"})
+	if err := validateExecuteRequest(&req); err != nil {
+		c.JSON(http.StatusBadRequest, newErrorResponse(err))
 		return
 	}
 
-	valid, err := verifyRecaptcha(req.Token)
+	valid, err := verifyRecaptcha(req.Token, clientIP)
+	if err != nil {
+		log.Printf("Captcha verification error: %v", err)
+	}
 	if err != nil || !valid {
 		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "reCAPTCHA verification failed"})
 		return
 	}
 
+	// Only requests that passed validation and the captcha use up the
+	// query budget
+	if !applyRateLimit(c, queryLimiters[req.Query]) {
+		return
+	}
+
 	var routerConfig RouterConfig
 	found := false
 	for _, router := range config.Routers {
@@ -600,19 +479,31 @@ func executeStreamingHandler(c *gin.Context) {
 		return
 	}
 
+	sendData, ok := newStreamSender(c.Writer)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Streaming unsupported"})
+		return
+	}
+	var redacted atomic.Bool
+	sendData = redactingSender(sendData, &redacted)
+
+	// Attendi uno slot libero sul router, segnalando la posizione in coda
+	release, err := routerSlots.acquire(c.Request.Context(), routerConfig, func(position int) {
+		sendData(StreamResponse{Type: "queued", Router: routerConfig.Name, Position: position})
+	})
+	if err != nil {
+		sendData(StreamResponse{Type: "error", Error: err.Error()})
+		logCommand(clientIP, req.Router, command, false, false)
+		return
+	}
+	defer release()
+
 	log.Printf("Starting streaming command from %s: %s", clientIP, command)
 
 	// Esegui comando in streaming
-	executeSSHCommandStreaming(
-		routerConfig.Connection.Host,
-		routerConfig.Connection.Port,
-		routerConfig.Connection.Username,
-		routerConfig.Connection.Password,
-		command,
-		c.Writer,
-	)
-
-	logCommand(clientIP, req.Router, command, true)
+	executeCommandStreaming(routerConfig, command, sendData)
+
+	logCommand(clientIP, req.Router, command, true, redacted.Load())
 }
 
 // ORIGINAL execute handler
@@ -625,18 +516,26 @@ func executeHandler(c *gin.Context) {
 
 	clientIP := c.ClientIP()
 
-	needsAddress := !contains([]string{"summary", "unicast neighbors"}, req.Query)
-	if needsAddress && req.Addr == "" {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Address is required for this query type"})
+	if err := validateExecuteRequest(&req); err != nil {
+		c.JSON(http.StatusBadRequest, newErrorResponse(err))
 		return
 	}
 
-	valid, err := verifyRecaptcha(req.Token)
+	valid, err := verifyRecaptcha(req.Token, clientIP)
+	if err != nil {
+		log.Printf("Captcha verification error: %v", err)
+	}
 	if err != nil || !valid {
 		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "reCAPTCHA verification failed"})
 		return
 	}
 
+	// Only requests that passed validation and the captcha use up the
+	// query budget
+	if !applyRateLimit(c, queryLimiters[req.Query]) {
+		return
+	}
+
 	var routerConfig RouterConfig
 	found := false
 	for _, router := range config.Routers {
@@ -658,28 +557,35 @@ func executeHandler(c *gin.Context) {
 		return
 	}
 
+	release, err := routerSlots.acquire(c.Request.Context(), routerConfig, nil)
+	if err != nil {
+		logCommand(clientIP, req.Router, command, false, false)
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: err.Error()})
+		return
+	}
+	defer release()
+
 	log.Printf("Executing command on %s: %s", routerConfig.Name, command)
-	output, err := executeSSHCommand(
-		routerConfig.Connection.Host,
-		routerConfig.Connection.Port,
-		routerConfig.Connection.Username,
-		routerConfig.Connection.Password,
-		command,
-	)
+	output, data, err := executeCommand(routerConfig, command)
 
 	if err != nil {
-		logCommand(clientIP, req.Router, command, false)
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Command execution failed: %v", err)})
+		message, redacted := redaction.line(fmt.Sprintf("Command execution failed: %v", err))
+		logCommand(clientIP, req.Router, command, false, redacted)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: message})
 		return
 	}
 
-	logCommand(clientIP, req.Router, command, true)
+	// Nasconde i dati sensibili prima che l'output lasci il server
+	output, outputRedacted := redaction.text(output)
+	data, dataRedacted := redaction.json(data)
+	logCommand(clientIP, req.Router, command, true, outputRedacted || dataRedacted)
 
 	response := ExecuteResponse{
 		Success:   true,
 		Router:    routerConfig.Title,
 		Command:   command,
 		Output:    output,
+		Data:      data,
 		Timestamp: time.Now().Format(time.RFC3339),
 	}
 
@@ -693,7 +599,7 @@ func healthHandler(c *gin.Context) {
 		"version":    "2.0.15-simple-streaming",
 		"routers":    len(config.Routers),
 		"protocol":   "SSH",
-		"algorithms": "Legacy Compatible",
+		"algorithms": "Per-router profiles",
 		"features":   "Simple JSON Streaming, Real-time output",
 	})
 }
@@ -718,9 +624,20 @@ func main() {
 	if err := loadConfig(); err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
+	if err := loadQueries(); err != nil {
+		log.Fatalf("Invalid command definitions: %v", err)
+	}
+	if config.Agent.Enabled {
+		runAgent()
+		return
+	}
 
-	rateValue := rate.Limit(float64(config.Security.RateLimit.Max) / float64(config.Security.RateLimit.WindowMs/1000))
-	rateLimiter = rate.NewLimiter(rateValue, config.Security.RateLimit.Max)
+	rateLimitConfig := config.Security.RateLimit
+	clientLimiter = newKeyedLimiter(rateLimitConfig.RateLimitRule, rateLimitConfig.MaxClients)
+	queryLimiters = make(map[string]*keyedLimiter)
+	for query, rule := range rateLimitConfig.Queries {
+		queryLimiters[query] = newKeyedLimiter(rule, rateLimitConfig.MaxClients)
+	}
 
 	if config.Security.SecureMode {
 		gin.SetMode(gin.ReleaseMode)
@@ -728,6 +645,13 @@ func main() {
 
 	r := gin.Default()
 
+	// By default gin trusts X-Forwarded-For from anyone, which would let
+	// clients pick their own rate limit bucket and captcha remote IP. No
+	// trustedProxies means no proxy is trusted.
+	if err := r.SetTrustedProxies(config.Security.TrustedProxies); err != nil {
+		log.Fatalf("Invalid trustedProxies: %v", err)
+	}
+
 	corsConfig := cors.DefaultConfig()
 	corsConfig.AllowOrigins = config.Security.AllowedOrigins
 	corsConfig.AllowCredentials = true
@@ -742,7 +666,9 @@ func main() {
 	api.Use(rateLimitMiddleware())
 	{
 		api.GET("/routers", getRoutersHandler)
-		api.POST("/execute", executeHandler)           // Original endpoint
+		api.GET("/queries", getQueriesHandler)
+		api.GET("/captcha", getCaptchaHandler)
+		api.POST("/execute", executeHandler)                 // Original endpoint
 		api.POST("/execute-stream", executeStreamingHandler) // NEW: Streaming endpoint
 		api.GET("/health", healthHandler)
 	}
@@ -759,7 +685,7 @@ func main() {
 		log.Printf("GoLine Looking Glass Server v2.0.15-SIMPLE-STREAMING")
 		log.Printf("Server running on http://localhost:3002")
 		log.Printf("Configured routers: %d", len(config.Routers))
-		log.Printf("Protocol: SSH with LEGACY algorithm support")
+		log.Printf("Protocol: SSH with per-router algorithm profiles")
 		log.Printf("Features: Simple JSON Streaming for real-time output")
 
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -767,6 +693,12 @@ func main() {
 		}
 	}()
 
+	waitForShutdown(srv)
+}
+
+// waitForShutdown blocks until SIGINT or SIGTERM, then stops srv and
+// closes the pooled SSH connections.
+func waitForShutdown(srv *http.Server) {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
@@ -780,5 +712,8 @@ func main() {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
 
+	sshConnPool.closeAll()
+	closeAPIClients()
+
 	log.Println("Server exited cleanly")
 }
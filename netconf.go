@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// NETCONF 1.0 framing and namespace (RFC 6242, RFC 6241)
+const (
+	netconfDelimiter = "]]>]]>"
+	netconfBaseNS    = "urn:ietf:params:xml:ns:netconf:base:1.0"
+)
+
+// junosRPCSpec maps a Junos CLI command to its XML RPC. Words listed in
+// values take the following words as the content of the given elements,
+// words in flags become empty elements and any other word fills the
+// positional element.
+type junosRPCSpec struct {
+	prefix     []string
+	rpc        string
+	positional string
+	values     map[string][]string
+	flags      []string
+}
+
+var junosRPCs = []junosRPCSpec{
+	{
+		prefix:     []string{"show", "route"},
+		rpc:        "get-route-information",
+		positional: "destination",
+		values: map[string][]string{
+			"table":                {"table"},
+			"protocol":             {"protocol"},
+			"advertising-protocol": {"advertising-protocol-name", "neighbor"},
+			"receive-protocol":     {"receive-protocol-name", "peer"},
+		},
+		flags: []string{"detail", "extensive", "terse", "brief", "exact", "best", "active-path", "all"},
+	},
+	{
+		prefix: []string{"show", "bgp", "summary"},
+		rpc:    "get-bgp-summary-information",
+	},
+	{
+		prefix:     []string{"show", "bgp", "neighbor"},
+		rpc:        "get-bgp-neighbor-information",
+		positional: "neighbor-address",
+	},
+	{
+		prefix:     []string{"ping"},
+		rpc:        "ping",
+		positional: "host",
+		values: map[string][]string{
+			"count": {"count"}, "source": {"source"}, "size": {"size"},
+			"ttl": {"ttl"}, "wait": {"wait"}, "routing-instance": {"routing-instance"},
+		},
+		flags: []string{"rapid", "inet", "inet6", "do-not-fragment"},
+	},
+	{
+		prefix:     []string{"traceroute"},
+		rpc:        "traceroute",
+		positional: "host",
+		values: map[string][]string{
+			"source": {"source"}, "ttl": {"ttl"}, "wait": {"wait"}, "routing-instance": {"routing-instance"},
+		},
+		flags: []string{"as-number-lookup", "inet", "inet6", "no-resolve"},
+	},
+}
+
+// junosRPC translates a CLI command into the body of a NETCONF <rpc>.
+// Commands without a known RPC go through <command>, which Junos accepts
+// for any operational command.
+func junosRPC(command string) string {
+	words := strings.Fields(command)
+
+	for _, spec := range junosRPCs {
+		if len(words) < len(spec.prefix) || strings.Join(words[:len(spec.prefix)], " ") != strings.Join(spec.prefix, " ") {
+			continue
+		}
+
+		var body strings.Builder
+		args := words[len(spec.prefix):]
+		for i := 0; i < len(args); i++ {
+			word := args[i]
+			if elements, ok := spec.values[word]; ok {
+				for _, element := range elements {
+					if i+1 < len(args) {
+						i++
+						writeXMLElement(&body, element, args[i])
+					}
+				}
+				continue
+			}
+			if contains(spec.flags, word) {
+				fmt.Fprintf(&body, "<%s/>", word)
+				continue
+			}
+			if spec.positional != "" {
+				writeXMLElement(&body, spec.positional, word)
+			}
+		}
+		return fmt.Sprintf("<%s>%s</%s>", spec.rpc, body.String(), spec.rpc)
+	}
+
+	return `<command format="xml">` + escapeXML(command) + "</command>"
+}
+
+func escapeXML(text string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(text))
+	return b.String()
+}
+
+func writeXMLElement(w *strings.Builder, name, text string) {
+	fmt.Fprintf(w, "<%s>%s</%s>", name, escapeXML(text), name)
+}
+
+// xmlNode is a generic XML element, namespaces and attributes dropped.
+type xmlNode struct {
+	Name     string
+	Text     string
+	Children []*xmlNode
+}
+
+func parseXMLNode(data []byte) (*xmlNode, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var stack []*xmlNode
+	var root *xmlNode
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{Name: t.Name.Local}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, node)
+			} else if root == nil {
+				root = node
+			}
+			stack = append(stack, node)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].Text += string(t)
+			}
+		}
+	}
+
+	if root == nil {
+		return nil, errors.New("empty XML document")
+	}
+	return root, nil
+}
+
+// child returns the first child element with the given name.
+func (n *xmlNode) child(name string) *xmlNode {
+	for _, c := range n.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// toJSON converts the element into JSON-friendly values: leaves become
+// strings, repeated children become arrays.
+func (n *xmlNode) toJSON() any {
+	if len(n.Children) == 0 {
+		return strings.TrimSpace(n.Text)
+	}
+
+	obj := map[string]any{}
+	for _, c := range n.Children {
+		value := c.toJSON()
+		switch existing := obj[c.Name].(type) {
+		case nil:
+			obj[c.Name] = value
+		case []any:
+			obj[c.Name] = append(existing, value)
+		default:
+			obj[c.Name] = []any{existing, value}
+		}
+	}
+	return obj
+}
+
+// render writes the element as indented "name: value" lines.
+func (n *xmlNode) render(depth int, emit func(line string)) {
+	indent := strings.Repeat("  ", depth)
+	if len(n.Children) == 0 {
+		text := strings.TrimSpace(n.Text)
+		if text == "" {
+			emit(indent + n.Name)
+		} else if strings.Contains(text, "\n") {
+			// Preformatted output such as the <output> of <command>
+			emit(indent + n.Name + ":")
+			for _, line := range strings.Split(text, "\n") {
+				emit(indent + "  " + line)
+			}
+		} else {
+			emit(indent + n.Name + ": " + text)
+		}
+		return
+	}
+
+	emit(indent + n.Name + ":")
+	for _, c := range n.Children {
+		c.render(depth+1, emit)
+	}
+}
+
+// NetconfError is an <rpc-error> of severity error returned by the router.
+type NetconfError struct {
+	Tag     string
+	Message string
+}
+
+func (e *NetconfError) Error() string {
+	if e.Message == "" {
+		return "NETCONF error: " + e.Tag
+	}
+	return "NETCONF error: " + e.Message
+}
+
+// readNetconfMessage reads one NETCONF 1.0 message, up to the end delimiter.
+func readNetconfMessage(r *bufio.Reader) ([]byte, error) {
+	var msg []byte
+	for {
+		chunk, err := r.ReadBytes('>')
+		msg = append(msg, chunk...)
+		if bytes.HasSuffix(msg, []byte(netconfDelimiter)) {
+			return bytes.TrimSpace(msg[:len(msg)-len(netconfDelimiter)]), nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("NETCONF read failed: %v", err)
+		}
+	}
+}
+
+// runNetconfCommand is the commandRunner for connection type "netconf". It
+// opens the NETCONF subsystem on a pooled SSH connection, runs the RPC for
+// the Junos command and returns the reply converted to JSON, emitting a
+// text rendering of it.
+func runNetconfCommand(router RouterConfig, command string, timeout time.Duration, emit func(line string)) (any, error) {
+	session, release, err := sshConnPool.newSession(router)
+	if err != nil {
+		return nil, errors.New(sshErrorMessage(err))
+	}
+	defer release()
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("stdin pipe failed: %v", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("stdout pipe failed: %v", err)
+	}
+	if err := session.RequestSubsystem("netconf"); err != nil {
+		return nil, fmt.Errorf("NETCONF subsystem request failed: %v", err)
+	}
+
+	// Closing the session unblocks any pending read
+	timer := time.AfterFunc(timeout, func() { session.Close() })
+	defer timer.Stop()
+
+	reader := bufio.NewReader(stdout)
+	if _, err := readNetconfMessage(reader); err != nil {
+		return nil, err
+	}
+
+	rpc := junosRPC(command)
+	log.Printf("NETCONF RPC on %s: %s", router.Name, rpc)
+
+	_, err = fmt.Fprintf(stdin, `<?xml version="1.0" encoding="UTF-8"?>`+
+		`<hello xmlns="%s"><capabilities><capability>urn:ietf:params:netconf:base:1.0</capability></capabilities></hello>%s`+
+		`<rpc message-id="1" xmlns="%s">%s</rpc>%s`,
+		netconfBaseNS, netconfDelimiter, netconfBaseNS, rpc, netconfDelimiter)
+	if err != nil {
+		return nil, fmt.Errorf("NETCONF write failed: %v", err)
+	}
+
+	reply, err := readNetconfMessage(reader)
+	if err != nil {
+		if !timer.Stop() {
+			return nil, fmt.Errorf("command timeout after %s", timeout)
+		}
+		return nil, err
+	}
+	fmt.Fprintf(stdin, `<rpc message-id="2" xmlns="%s"><close-session/></rpc>%s`, netconfBaseNS, netconfDelimiter)
+
+	root, err := parseXMLNode(reply)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NETCONF reply: %v", err)
+	}
+
+	result := map[string]any{}
+	for _, c := range root.Children {
+		if c.Name == "rpc-error" {
+			severity := c.child("error-severity")
+			if severity == nil || strings.TrimSpace(severity.Text) == "error" {
+				netconfErr := &NetconfError{}
+				if tag := c.child("error-tag"); tag != nil {
+					netconfErr.Tag = strings.TrimSpace(tag.Text)
+				}
+				if msg := c.child("error-message"); msg != nil {
+					netconfErr.Message = strings.TrimSpace(msg.Text)
+				}
+				return nil, netconfErr
+			}
+			continue
+		}
+		c.render(0, emit)
+		result[c.Name] = c.toJSON()
+	}
+	return result, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestReadNetconfMessage(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []string
+	}{
+		{"one message", "<hello/>]]>]]>", []string{"<hello/>"}},
+		{"back to back", "<hello/>\n]]>]]>\n<rpc-reply/>]]>]]>", []string{"<hello/>", "<rpc-reply/>"}},
+		{"delimiter characters in the text", "<output>a]]>b ]]> c</output>]]>]]>", []string{"<output>a]]>b ]]> c</output>"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// One byte at a time, so the delimiter is split across reads
+			r := bufio.NewReader(iotest.OneByteReader(strings.NewReader(tt.stream)))
+			var got []string
+			for range tt.want {
+				msg, err := readNetconfMessage(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, string(msg))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("messages = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := readNetconfMessage(bufio.NewReader(strings.NewReader("<rpc-reply>cut"))); err == nil {
+		t.Error("stream ended before the delimiter: want an error")
+	}
+}
+
+// netconfSession is what the stub saw the client send.
+type netconfSession struct {
+	subsystem string
+	messages  []string
+}
+
+// startNetconfStub serves a NETCONF subsystem sending hello, then answering
+// the first <rpc> with reply and waiting for <close-session>.
+func startNetconfStub(t *testing.T, reply string) (RouterConfig, <-chan netconfSession) {
+	t.Helper()
+
+	sessions := make(chan netconfSession, 1)
+	router, _ := serveTestSSHWith(t, &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}, func(chans <-chan ssh.NewChannel) {
+		for newChannel := range chans {
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go func() {
+				defer channel.Close()
+				var s netconfSession
+				defer func() { sessions <- s }()
+
+				req, ok := <-requests
+				if !ok {
+					return
+				}
+				if req.Type == "subsystem" && len(req.Payload) > 4 {
+					s.subsystem = string(req.Payload[4:])
+				}
+				req.Reply(s.subsystem == "netconf", nil)
+				if s.subsystem != "netconf" {
+					return
+				}
+				go ssh.DiscardRequests(requests)
+
+				fmt.Fprintf(channel, `<?xml version="1.0" encoding="UTF-8"?>`+
+					`<hello xmlns="%s"><capabilities><capability>urn:ietf:params:netconf:base:1.0</capability>`+
+					`</capabilities><session-id>42</session-id></hello>%s`, netconfBaseNS, netconfDelimiter)
+
+				r := bufio.NewReader(channel)
+				for {
+					msg, err := readNetconfMessage(r)
+					if err != nil {
+						return
+					}
+					s.messages = append(s.messages, string(msg))
+					switch {
+					case strings.Contains(string(msg), "<close-session/>"):
+						fmt.Fprintf(channel, `<rpc-reply message-id="2" xmlns="%s"><ok/></rpc-reply>%s`, netconfBaseNS, netconfDelimiter)
+						return
+					case strings.Contains(string(msg), "<rpc "):
+						// Split the reply inside the delimiter
+						framed := reply + netconfDelimiter
+						channel.Write([]byte(framed[:len(framed)-3]))
+						time.Sleep(10 * time.Millisecond)
+						channel.Write([]byte(framed[len(framed)-3:]))
+					}
+				}
+			}()
+		}
+	})
+	router.Connection.Type = "netconf"
+	router.Connection.Password = "secret"
+	router.OSType = "junos"
+	return router, sessions
+}
+
+func TestNetconfHelloAndRPC(t *testing.T) {
+	router, sessions := startNetconfStub(t, `<rpc-reply message-id="1" xmlns="`+netconfBaseNS+`">`+
+		`<bgp-information><peer-count>2</peer-count>`+
+		`<bgp-peer><peer-address>192.0.2.1</peer-address></bgp-peer>`+
+		`<bgp-peer><peer-address>192.0.2.2</peer-address></bgp-peer>`+
+		`</bgp-information></rpc-reply>`)
+
+	var lines []string
+	data, err := runNetconfCommand(router, "show bgp summary", 2*time.Second, func(line string) {
+		lines = append(lines, line)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s netconfSession
+	select {
+	case s = <-sessions:
+	case <-time.After(2 * time.Second):
+		t.Fatal("session not closed")
+	}
+	if s.subsystem != "netconf" {
+		t.Errorf("subsystem = %q", s.subsystem)
+	}
+	if len(s.messages) != 3 {
+		t.Fatalf("client sent %d messages, want hello, rpc and close-session: %q", len(s.messages), s.messages)
+	}
+	if hello := s.messages[0]; !strings.Contains(hello, "<hello ") || !strings.Contains(hello, "urn:ietf:params:netconf:base:1.0") {
+		t.Errorf("hello = %q", hello)
+	}
+	if rpc := s.messages[1]; !strings.Contains(rpc, `message-id="1"`) || !strings.Contains(rpc, "<get-bgp-summary-information></get-bgp-summary-information>") {
+		t.Errorf("rpc = %q", rpc)
+	}
+
+	want := map[string]any{"bgp-information": map[string]any{
+		"peer-count": "2",
+		"bgp-peer": []any{
+			map[string]any{"peer-address": "192.0.2.1"},
+			map[string]any{"peer-address": "192.0.2.2"},
+		},
+	}}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("data = %#v, want %#v", data, want)
+	}
+	wantLines := []string{
+		"bgp-information:",
+		"  peer-count: 2",
+		"  bgp-peer:",
+		"    peer-address: 192.0.2.1",
+		"  bgp-peer:",
+		"    peer-address: 192.0.2.2",
+	}
+	if !reflect.DeepEqual(lines, wantLines) {
+		t.Errorf("lines = %q, want %q", lines, wantLines)
+	}
+}
+
+func TestNetconfRPCError(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		err   string
+	}{
+		{
+			name: "error",
+			reply: `<rpc-error><error-type>protocol</error-type><error-tag>operation-failed</error-tag>` +
+				`<error-severity>error</error-severity><error-message>syntax error, expecting &lt;command&gt;</error-message></rpc-error>`,
+			err: "NETCONF error: syntax error, expecting <command>",
+		},
+		{
+			name:  "error without message",
+			reply: `<rpc-error><error-tag>access-denied</error-tag><error-severity>error</error-severity></rpc-error>`,
+			err:   "NETCONF error: access-denied",
+		},
+		{
+			// Warnings do not fail the command
+			name: "warning",
+			reply: `<rpc-error><error-severity>warning</error-severity><error-message>mgd: statement has no contents</error-message></rpc-error>` +
+				`<route-information><destination-count>0</destination-count></route-information>`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router, _ := startNetconfStub(t, `<rpc-reply message-id="1" xmlns="`+netconfBaseNS+`">`+tt.reply+`</rpc-reply>`)
+
+			data, err := runNetconfCommand(router, "show route 192.0.2.0/24", 2*time.Second, func(string) {})
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, ok := data.(map[string]any)["route-information"]; !ok {
+					t.Errorf("data = %#v", data)
+				}
+				return
+			}
+			var netconfErr *NetconfError
+			if !errors.As(err, &netconfErr) || err.Error() != tt.err {
+				t.Errorf("got %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
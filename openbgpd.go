@@ -0,0 +1,19 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// runBgpctlCommand is the commandRunner for connection type "bgpctl":
+// OpenBGPD running on the Looking Glass host itself. The command words are
+// passed to bgpctl -j as separate arguments, the JSON answer is turned into
+// structured data by executeCommand.
+func runBgpctlCommand(router RouterConfig, command string, timeout time.Duration, emit func(line string)) (any, error) {
+	bgpctl := router.Connection.Binary
+	if bgpctl == "" {
+		bgpctl = "bgpctl"
+	}
+	argv := append([]string{bgpctl, "-j"}, strings.Fields(command)...)
+	return nil, runProcess(argv, timeout, emit)
+}
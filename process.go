@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// runProcess executes argv directly (never through a shell) and emits its
+// stdout and stderr line by line. The process is killed after timeout.
+func runProcess(argv []string, timeout time.Duration, emit func(line string)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("stdout pipe failed: %v", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("stderr pipe failed: %v", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %v", argv[0], err)
+	}
+
+	// emit is not required to be goroutine safe
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var readErr error
+	readLines := func(r io.Reader) {
+		defer wg.Done()
+		// vtysh and bgpctl print whole JSON documents on a single line
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 16<<20)
+		for scanner.Scan() {
+			mu.Lock()
+			emit(scanner.Text())
+			mu.Unlock()
+		}
+		if err := scanner.Err(); err != nil {
+			mu.Lock()
+			if readErr == nil {
+				readErr = err
+			}
+			mu.Unlock()
+			// Keep the pipe drained so the process does not block on it
+			io.Copy(io.Discard, r)
+		}
+	}
+	wg.Add(2)
+	go readLines(stdout)
+	go readLines(stderr)
+	wg.Wait()
+
+	err = cmd.Wait()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("command timeout after %s", timeout)
+	}
+	if readErr != nil {
+		return fmt.Errorf("failed to read the output of %s: %v", argv[0], readErr)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// Tools like ping report unreachable targets through the exit
+		// status; the output already tells the user what happened
+		return nil
+	}
+	return err
+}
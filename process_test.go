@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunProcessLongLines(t *testing.T) {
+	var lines []string
+	emit := func(line string) { lines = append(lines, line) }
+
+	// One line well above the default 64 KiB token limit of bufio.Scanner
+	err := runProcess([]string{"sh", "-c", "head -c 1000000 /dev/zero | tr '\\0' a; echo; echo done"}, 10*time.Second, emit)
+	if err != nil {
+		t.Fatalf("runProcess failed: %v", err)
+	}
+	if len(lines) != 2 || len(lines[0]) != 1000000 || lines[1] != "done" {
+		t.Fatalf("got %d lines, want the long line and \"done\"", len(lines))
+	}
+}
+
+func TestRunProcessLineTooLong(t *testing.T) {
+	emit := func(string) {}
+
+	// The reader must keep draining the pipe, or the process would block
+	// until the timeout
+	start := time.Now()
+	err := runProcess([]string{"sh", "-c", "head -c 20000000 /dev/zero | tr '\\0' a; echo"}, 30*time.Second, emit)
+	if err == nil || !strings.Contains(err.Error(), "too long") {
+		t.Fatalf("runProcess error = %v, want a token too long error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("runProcess returned after %s", elapsed)
+	}
+}
+
+func TestRunProcessTimeout(t *testing.T) {
+	err := runProcess([]string{"sleep", "5"}, 100*time.Millisecond, func(string) {})
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("runProcess error = %v, want a timeout", err)
+	}
+}
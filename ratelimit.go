@@ -0,0 +1,181 @@
+package main
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// Upper bound on tracked clients when rateLimit.maxClients is not set
+const defaultMaxClients = 10000
+
+// keyedLimiter holds one token bucket per client key. Buckets are kept in
+// LRU order and evicted once idle for a full window, or when the number of
+// tracked clients exceeds maxKeys.
+type keyedLimiter struct {
+	mu      sync.Mutex
+	limit   rate.Limit
+	burst   int
+	window  time.Duration
+	maxKeys int
+	entries map[string]*list.Element
+	lru     *list.List // front = most recently used
+}
+
+type bucketEntry struct {
+	key      string
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimitResult carries what is needed for the RateLimit-* headers.
+type rateLimitResult struct {
+	allowed    bool
+	limit      int
+	remaining  int
+	reset      time.Duration
+	retryAfter time.Duration
+}
+
+// newKeyedLimiter returns nil when the rule does not limit anything.
+func newKeyedLimiter(rule RateLimitRule, maxKeys int) *keyedLimiter {
+	if rule.Max <= 0 || rule.WindowMs <= 0 {
+		return nil
+	}
+	if maxKeys <= 0 {
+		maxKeys = defaultMaxClients
+	}
+
+	window := time.Duration(rule.WindowMs) * time.Millisecond
+	return &keyedLimiter{
+		limit:   rate.Limit(float64(rule.Max) / window.Seconds()),
+		burst:   rule.Max,
+		window:  window,
+		maxKeys: maxKeys,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (k *keyedLimiter) allow(key string) rateLimitResult {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := time.Now()
+	k.evict(now, 0)
+
+	var entry *bucketEntry
+	if elem, ok := k.entries[key]; ok {
+		entry = elem.Value.(*bucketEntry)
+		k.lru.MoveToFront(elem)
+	} else {
+		k.evict(now, 1)
+		entry = &bucketEntry{key: key, limiter: rate.NewLimiter(k.limit, k.burst)}
+		k.entries[key] = k.lru.PushFront(entry)
+	}
+	entry.lastSeen = now
+
+	result := rateLimitResult{limit: k.burst}
+	result.allowed = entry.limiter.AllowN(now, 1)
+
+	tokens := entry.limiter.TokensAt(now)
+	result.remaining = int(math.Max(0, math.Floor(tokens)))
+	result.reset = k.durationFor(float64(k.burst) - tokens)
+	if !result.allowed {
+		result.retryAfter = k.durationFor(1 - tokens)
+	}
+	return result
+}
+
+// evict drops buckets that have been idle for a whole window (they would be
+// full again anyway) and the least recently used ones until there is room
+// for the given number of new buckets.
+func (k *keyedLimiter) evict(now time.Time, room int) {
+	for {
+		elem := k.lru.Back()
+		if elem == nil {
+			return
+		}
+		entry := elem.Value.(*bucketEntry)
+		if now.Sub(entry.lastSeen) < k.window && k.lru.Len()+room <= k.maxKeys {
+			return
+		}
+		k.lru.Remove(elem)
+		delete(k.entries, entry.key)
+	}
+}
+
+// durationFor returns how long it takes to refill the given number of tokens.
+func (k *keyedLimiter) durationFor(tokens float64) time.Duration {
+	if tokens <= 0 {
+		return 0
+	}
+	return time.Duration(tokens / float64(k.limit) * float64(time.Second))
+}
+
+// rateLimitKey groups IPv6 clients by /64, since a single host usually
+// controls the whole subnet.
+func rateLimitKey(clientIP string) string {
+	ip, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return clientIP
+	}
+	ip = ip.Unmap()
+	if ip.Is4() {
+		return ip.String()
+	}
+	return netip.PrefixFrom(ip.WithZone(""), 64).Masked().String()
+}
+
+// Context key of the rateLimitResult reported in the headers so far
+const rateLimitResultKey = "rateLimitResult"
+
+// stricterThan tells whether r leaves the client fewer requests than o.
+func (r rateLimitResult) stricterThan(o rateLimitResult) bool {
+	if r.remaining != o.remaining {
+		return r.remaining < o.remaining
+	}
+	return r.reset > o.reset
+}
+
+// applyRateLimit charges one request to the client's bucket, sets the
+// RateLimit-* headers and answers 429 when the bucket is empty. It returns
+// false if the request must not proceed. When several limits apply to a
+// request, the headers describe the stricter one.
+func applyRateLimit(c *gin.Context, limiter *keyedLimiter) bool {
+	if limiter == nil {
+		return true
+	}
+
+	result := limiter.allow(rateLimitKey(c.ClientIP()))
+	if previous, ok := c.Get(rateLimitResultKey); ok && result.allowed {
+		if previous := previous.(rateLimitResult); previous.stricterThan(result) {
+			result = previous
+		}
+	}
+	c.Set(rateLimitResultKey, result)
+
+	c.Header("RateLimit-Limit", strconv.Itoa(result.limit))
+	c.Header("RateLimit-Remaining", strconv.Itoa(result.remaining))
+	c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.reset)))
+
+	if !result.allowed {
+		c.Header("Retry-After", strconv.Itoa(ceilSeconds(result.retryAfter)))
+		c.JSON(http.StatusTooManyRequests, ErrorResponse{
+			Error: "Too many requests, please try again later.",
+		})
+		return false
+	}
+	return true
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
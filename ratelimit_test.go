@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestKeyedLimiterRefill(t *testing.T) {
+	limiter := newKeyedLimiter(RateLimitRule{Max: 2, WindowMs: 200}, 0)
+
+	for i := 0; i < 2; i++ {
+		if result := limiter.allow("a"); !result.allowed || result.remaining != 1-i {
+			t.Fatalf("request %d: %+v", i+1, result)
+		}
+	}
+	result := limiter.allow("a")
+	if result.allowed {
+		t.Fatal("third request within the window allowed")
+	}
+	// One token comes back every 100ms
+	if result.retryAfter <= 0 || result.retryAfter > 100*time.Millisecond {
+		t.Errorf("retryAfter = %s, want up to 100ms", result.retryAfter)
+	}
+	if !limiter.allow("b").allowed {
+		t.Error("other client limited")
+	}
+
+	time.Sleep(result.retryAfter + 20*time.Millisecond)
+	if !limiter.allow("a").allowed {
+		t.Error("no token refilled after retryAfter")
+	}
+}
+
+func TestKeyedLimiterEviction(t *testing.T) {
+	limiter := newKeyedLimiter(RateLimitRule{Max: 1, WindowMs: 60000}, 2)
+
+	limiter.allow("a")
+	limiter.allow("b")
+	limiter.allow("a") // a is now the most recently used
+	limiter.allow("c")
+
+	if len(limiter.entries) != 2 {
+		t.Fatalf("%d clients tracked, want 2", len(limiter.entries))
+	}
+	if _, ok := limiter.entries["b"]; ok {
+		t.Error("least recently used client b not evicted")
+	}
+	if _, ok := limiter.entries["a"]; !ok {
+		t.Error("recently used client a evicted")
+	}
+	// An evicted client starts over with a full bucket
+	if !limiter.allow("b").allowed {
+		t.Error("evicted client still limited")
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.1":            "192.0.2.1",
+		"::ffff:192.0.2.1":     "192.0.2.1",
+		"2001:db8:1:2:3:4:5:6": "2001:db8:1:2::/64",
+		"2001:db8:1:2::1":      "2001:db8:1:2::/64",
+		"fe80::1%eth0":         "fe80::/64",
+		"not-an-ip":            "not-an-ip",
+	}
+	for ip, want := range tests {
+		if got := rateLimitKey(ip); got != want {
+			t.Errorf("rateLimitKey(%q) = %q, want %q", ip, got, want)
+		}
+	}
+	if rateLimitKey("2001:db8:1:2::1") == rateLimitKey("2001:db8:1:3::1") {
+		t.Error("different /64s share a bucket")
+	}
+}
+
+// limitedRequest runs a request through the global and the query limiter
+// like the execute handlers do.
+func limitedRequest(global, query *keyedLimiter) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/execute", nil)
+	c.Request.RemoteAddr = "192.0.2.1:12345"
+
+	if applyRateLimit(c, global) && applyRateLimit(c, query) {
+		c.Status(http.StatusOK)
+	}
+	return w
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	global := newKeyedLimiter(RateLimitRule{Max: 10, WindowMs: 60000}, 0)
+	query := newKeyedLimiter(RateLimitRule{Max: 2, WindowMs: 60000}, 0)
+
+	// The query limit has fewer requests left, so it is the one reported
+	w := limitedRequest(global, query)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	if limit, remaining := w.Header().Get("RateLimit-Limit"), w.Header().Get("RateLimit-Remaining"); limit != "2" || remaining != "1" {
+		t.Errorf("RateLimit-Limit %s, RateLimit-Remaining %s, want 2 and 1", limit, remaining)
+	}
+
+	// The global limit is reported for requests without a query limit
+	w = limitedRequest(global, nil)
+	if limit, remaining := w.Header().Get("RateLimit-Limit"), w.Header().Get("RateLimit-Remaining"); limit != "10" || remaining != "8" {
+		t.Errorf("RateLimit-Limit %s, RateLimit-Remaining %s, want 10 and 8", limit, remaining)
+	}
+
+	limitedRequest(global, query)
+	w = limitedRequest(global, query)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429", w.Code)
+	}
+	if w.Header().Get("RateLimit-Remaining") != "0" || w.Header().Get("Retry-After") == "" {
+		t.Errorf("headers = %v", w.Header())
+	}
+	if reset := w.Header().Get("RateLimit-Reset"); reset == "" || reset == "0" {
+		t.Errorf("RateLimit-Reset = %q", reset)
+	}
+}
+
+func TestFailedCaptchaKeepsQueryBudget(t *testing.T) {
+	savedCaptcha, savedLimiter, savedQueries := config.Recaptcha, clientLimiter, queryLimiters
+	defer func() { config.Recaptcha, clientLimiter, queryLimiters = savedCaptcha, savedLimiter, savedQueries }()
+
+	config.Recaptcha = RecaptchaConfig{
+		Enabled:   true,
+		Provider:  "hcaptcha",
+		SecretKey: "test-secret",
+		VerifyURL: startCaptchaStub(t, http.StatusOK, `{"success": false}`),
+	}
+	clientLimiter = nil
+	queryLimiters = map[string]*keyedLimiter{"summary": newKeyedLimiter(RateLimitRule{Max: 1, WindowMs: 60000}, 0)}
+
+	gin.SetMode(gin.TestMode)
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/execute",
+			strings.NewReader(`{"router": "r1", "query": "summary", "protocol": "IPv4", "token": "test-token"}`))
+		c.Request.RemoteAddr = "192.0.2.1:12345"
+		executeHandler(c)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("request %d: status %d, want 400 for the captcha", i+1, w.Code)
+		}
+	}
+	if result := queryLimiters["summary"].allow("192.0.2.1"); !result.allowed {
+		t.Error("failed captchas used up the query budget")
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// RedactionConfig selects what is masked in the output before it is sent to
+// clients, on every router.
+type RedactionConfig struct {
+	PrivateAddresses bool     `json:"privateAddresses"` // RFC 1918 and ULA (fc00::/7) addresses
+	InternalPrefixes []string `json:"internalPrefixes"` // addresses inside these prefixes
+	AuthLines        bool     `json:"authLines"`        // MD5 keys, passwords and secrets
+	Patterns         []string `json:"patterns"`         // any other regex
+}
+
+// Address candidates, checked with netip before being masked. An IPv6
+// candidate may take a trailing colon of the text around it.
+var (
+	ipv4Candidate = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}(?:/\d{1,2})?\b`)
+	ipv6Candidate = regexp.MustCompile(`(?i)(?:[0-9a-f]{0,4}:){2,7}[0-9a-f]{0,4}(?:/\d{1,3})?`)
+
+	// "MD5 key: ...", "Password : Cipher ...", "Authentication key is configured"
+	authLineRegex = regexp.MustCompile(`(?i)\b(md5(?:[- ]key)?|password|passwd|secret|authentication[- ]key|auth[- ]key)\b(\s*(?:is\s+|[:=]\s*)?)(\S.*)$`)
+)
+
+// redaction is the active redactor, nil when nothing is redacted.
+var redaction *redactor
+
+type redactor struct {
+	privateAddresses bool
+	internalPrefixes []netip.Prefix
+	authLines        bool
+	patterns         []*regexp.Regexp
+}
+
+// compileRedaction builds the redactor from the config.
+func compileRedaction() error {
+	cfg := config.Redaction
+	r := &redactor{privateAddresses: cfg.PrivateAddresses, authLines: cfg.AuthLines}
+	for _, s := range cfg.InternalPrefixes {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return fmt.Errorf("invalid internal prefix %q: %v", s, err)
+		}
+		r.internalPrefixes = append(r.internalPrefixes, prefix.Masked())
+	}
+	for _, s := range cfg.Patterns {
+		pattern, err := regexp.Compile(s)
+		if err != nil {
+			return fmt.Errorf("invalid redaction pattern %q: %v", s, err)
+		}
+		r.patterns = append(r.patterns, pattern)
+	}
+
+	redaction = nil
+	if r.privateAddresses || r.authLines || len(r.internalPrefixes) > 0 || len(r.patterns) > 0 {
+		redaction = r
+	}
+	return nil
+}
+
+// hidden tells whether an address (or the network of a prefix) is masked.
+func (r *redactor) hidden(token string) bool {
+	addr, err := netip.ParseAddr(token)
+	if err != nil {
+		prefix, err := netip.ParsePrefix(token)
+		if err != nil {
+			return false
+		}
+		addr = prefix.Addr()
+	}
+	addr = addr.Unmap()
+
+	if r.privateAddresses && addr.IsPrivate() {
+		return true
+	}
+	for _, prefix := range r.internalPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// line returns the line with sensitive data masked, and whether anything
+// was.
+func (r *redactor) line(line string) (string, bool) {
+	if r == nil {
+		return line, false
+	}
+	original := line
+
+	if r.privateAddresses || len(r.internalPrefixes) > 0 {
+		line = ipv4Candidate.ReplaceAllStringFunc(line, func(token string) string {
+			if r.hidden(token) {
+				return redactedText
+			}
+			return token
+		})
+		line = ipv6Candidate.ReplaceAllStringFunc(line, func(token string) string {
+			core, suffix := token, ""
+			if strings.HasSuffix(core, ":") && !strings.HasSuffix(core, "::") {
+				core, suffix = core[:len(core)-1], ":"
+			}
+			if r.hidden(core) {
+				return redactedText + suffix
+			}
+			return token
+		})
+	}
+	if r.authLines {
+		line = authLineRegex.ReplaceAllString(line, "${1}${2}"+redactedText)
+	}
+	for _, pattern := range r.patterns {
+		line = pattern.ReplaceAllString(line, redactedText)
+	}
+	return line, line != original
+}
+
+// text masks every line of a multi-line output.
+func (r *redactor) text(text string) (string, bool) {
+	if r == nil {
+		return text, false
+	}
+	lines := strings.Split(text, "\n")
+	changed := false
+	for i, line := range lines {
+		var lineChanged bool
+		lines[i], lineChanged = r.line(line)
+		changed = changed || lineChanged
+	}
+	return strings.Join(lines, "\n"), changed
+}
+
+// json masks every string in a structured result, map keys included: FRR
+// and others key their JSON by neighbor address.
+func (r *redactor) json(data json.RawMessage) (json.RawMessage, bool) {
+	if r == nil || len(data) == 0 {
+		return data, false
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return data, false
+	}
+
+	changed := false
+	var walk func(v any) any
+	walk = func(v any) any {
+		switch v := v.(type) {
+		case string:
+			redacted, lineChanged := r.text(v)
+			changed = changed || lineChanged
+			return redacted
+		case []any:
+			for i := range v {
+				v[i] = walk(v[i])
+			}
+		case map[string]any:
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+
+			out := make(map[string]any, len(v))
+			for _, key := range keys {
+				value := walk(v[key])
+				redactedKey, keyChanged := r.line(key)
+				changed = changed || keyChanged
+				if existing, ok := out[redactedKey]; ok {
+					value = mergeJSON(existing, value)
+				}
+				out[redactedKey] = value
+			}
+			return out
+		}
+		return v
+	}
+	value = walk(value)
+	if !changed {
+		return data, false
+	}
+
+	redacted, err := json.Marshal(value)
+	if err != nil {
+		return data, false
+	}
+	return redacted, true
+}
+
+// mergeJSON combines the values of two keys redacted to the same text:
+// objects are merged, anything else is collected in an array.
+func mergeJSON(a, b any) any {
+	aMap, aIsMap := a.(map[string]any)
+	bMap, bIsMap := b.(map[string]any)
+	if aIsMap && bIsMap {
+		keys := make([]string, 0, len(bMap))
+		for key := range bMap {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := bMap[key]
+			if existing, ok := aMap[key]; ok {
+				value = mergeJSON(existing, value)
+			}
+			aMap[key] = value
+		}
+		return aMap
+	}
+
+	aList, aIsList := a.([]any)
+	bList, bIsList := b.([]any)
+	switch {
+	case aIsList && bIsList:
+		return append(aList, bList...)
+	case aIsList:
+		return append(aList, b)
+	case bIsList:
+		return append([]any{a}, bList...)
+	}
+	return []any{a, b}
+}
+
+// redactingSender wraps a stream sender so the output and errors of every
+// event are redacted, recording in redacted whether anything was.
+func redactingSender(sendData func(StreamResponse), redacted *atomic.Bool) func(StreamResponse) {
+	if redaction == nil {
+		return sendData
+	}
+	return func(resp StreamResponse) {
+		var changed [3]bool
+		resp.Data, changed[0] = redaction.line(resp.Data)
+		resp.Error, changed[1] = redaction.line(resp.Error)
+		resp.Result, changed[2] = redaction.json(resp.Result)
+		if changed[0] || changed[1] || changed[2] {
+			redacted.Store(true)
+		}
+		sendData(resp)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useRedaction compiles cfg as the active redaction for the test.
+func useRedaction(t *testing.T, cfg RedactionConfig) {
+	t.Helper()
+	saved, savedRedaction := config.Redaction, redaction
+	t.Cleanup(func() { config.Redaction, redaction = saved, savedRedaction })
+	config.Redaction = cfg
+	if err := compileRedaction(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedactLine(t *testing.T) {
+	useRedaction(t, RedactionConfig{
+		PrivateAddresses: true,
+		InternalPrefixes: []string{"198.51.100.0/24", "2001:db8:ffff::/48"},
+		AuthLines:        true,
+		Patterns:         []string{`(?i)community \d+:666`},
+	})
+
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"BGP neighbor is 10.1.2.3, remote AS 64500", "BGP neighbor is [redacted], remote AS 64500"},
+		{"BGP neighbor is 192.0.2.1, remote AS 64500", "BGP neighbor is 192.0.2.1, remote AS 64500"},
+		{"*> 172.16.0.0/12  via 192.0.2.1", "*> [redacted]  via 192.0.2.1"},
+		{"next hop 198.51.100.7 (internal)", "next hop [redacted] (internal)"},
+		{"Peer fd00::1: Established", "Peer [redacted]: Established"},
+		{"Peer 2001:db8:ffff:1::2 is up", "Peer [redacted] is up"},
+		{"Peer 2001:db8:1::2 is up", "Peer 2001:db8:1::2 is up"},
+		{"::ffff:10.0.0.1 mapped", "::ffff:[redacted] mapped"},
+		{"Time 12:30:45 and 999.1.1.1", "Time 12:30:45 and 999.1.1.1"},
+		{"  MD5 key: s3cret", "  MD5 key: [redacted]"},
+		{"Password : Cipher %^%#abc", "Password : [redacted]"},
+		{"Authentication key is configured", "Authentication key is [redacted]"},
+		{"Community 64500:666 attached", "[redacted] attached"},
+	}
+	for _, tt := range tests {
+		got, changed := redaction.line(tt.line)
+		if got != tt.want || changed != (tt.line != tt.want) {
+			t.Errorf("line(%q) = %q, %t, want %q", tt.line, got, changed, tt.want)
+		}
+	}
+
+	text, changed := redaction.text("Peer 10.0.0.1\nPeer 192.0.2.1")
+	if text != "Peer [redacted]\nPeer 192.0.2.1" || !changed {
+		t.Errorf("text = %q, %t", text, changed)
+	}
+}
+
+func TestRedactJSON(t *testing.T) {
+	useRedaction(t, RedactionConfig{PrivateAddresses: true})
+
+	tests := []struct {
+		name string
+		data string
+		want string // empty when nothing changes
+	}{
+		{
+			name: "values",
+			data: `{"neighbor": "10.1.2.3", "as": 64500, "hops": ["192.0.2.1", "172.16.0.1"]}`,
+			want: `{"as":64500,"hops":["192.0.2.1","[redacted]"],"neighbor":"[redacted]"}`,
+		},
+		{
+			name: "keys",
+			data: `{"peers": {"10.1.2.3": {"remoteAs": 64500}, "192.0.2.1": {"remoteAs": 64501}}}`,
+			want: `{"peers":{"192.0.2.1":{"remoteAs":64501},"[redacted]":{"remoteAs":64500}}}`,
+		},
+		{
+			// Both peers end up under the same key
+			name: "colliding keys",
+			data: `{"peers": {"10.1.2.3": {"remoteAs": 64500, "state": "up"}, "10.1.2.4": {"remoteAs": 64501}}}`,
+			want: `{"peers":{"[redacted]":{"remoteAs":[64500,64501],"state":"up"}}}`,
+		},
+		{
+			name: "colliding scalar keys",
+			data: `{"nexthops": {"10.0.0.1": 1, "10.0.0.2": 2, "10.0.0.3": 3}}`,
+			want: `{"nexthops":{"[redacted]":[1,2,3]}}`,
+		},
+		{
+			name: "nothing to redact",
+			data: `{"peers": {"192.0.2.1": {"remoteAs": 64500}}}`,
+		},
+		{
+			name: "not JSON",
+			data: `10.1.2.3`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, changed := redaction.json(json.RawMessage(tt.data))
+			want := tt.want
+			if want == "" {
+				want = tt.data
+			}
+			if string(got) != want || changed != (tt.want != "") {
+				t.Errorf("json = %s, %t, want %s", got, changed, want)
+			}
+		})
+	}
+
+	// Numbers keep their exact value
+	got, _ := redaction.json(json.RawMessage(`{"10.0.0.1": 18446744073709551615}`))
+	if string(got) != `{"[redacted]":18446744073709551615}` {
+		t.Errorf("json = %s", got)
+	}
+}
+
+func TestRedactingSender(t *testing.T) {
+	useRedaction(t, RedactionConfig{PrivateAddresses: true})
+
+	var redacted atomic.Bool
+	var sent []StreamResponse
+	send := redactingSender(func(resp StreamResponse) { sent = append(sent, resp) }, &redacted)
+
+	send(StreamResponse{Type: "data", Data: "Peer 192.0.2.1"})
+	if redacted.Load() {
+		t.Fatal("redacted set without anything masked")
+	}
+	send(StreamResponse{Type: "complete", Result: json.RawMessage(`{"10.1.2.3": {}}`)})
+	if !redacted.Load() {
+		t.Error("redacted not set for a masked JSON key")
+	}
+	if string(sent[1].Result) != `{"[redacted]":{}}` {
+		t.Errorf("result = %s", sent[1].Result)
+	}
+}
+
+func TestRedactionAuditLog(t *testing.T) {
+	useRedaction(t, RedactionConfig{PrivateAddresses: true})
+	savedRouters, savedLogFile := config.Routers, config.LogFile
+	defer func() { config.Routers, config.LogFile = savedRouters, savedLogFile }()
+	config.LogFile = filepath.Join(t.TempDir(), "looking-glass.log")
+
+	// BIRD answering with JSON keyed by neighbor
+	router, _ := startBirdStub(t, map[string]string{
+		"show protocols": `1002-{"peers": {"10.1.2.3": {"state": "Established"}}}` + "\n0000 \n",
+	})
+	router.Title = "BIRD"
+	router.IPv4Enabled = true
+	config.Routers = []RouterConfig{router}
+
+	gin.SetMode(gin.TestMode)
+	execute := func() ExecuteResponse {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/execute",
+			strings.NewReader(`{"router": "bird1", "query": "summary", "protocol": "IPv4"}`))
+		c.Request.RemoteAddr = "192.0.2.1:12345"
+		executeHandler(c)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		var resp ExecuteResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := execute()
+	if strings.Contains(resp.Output, "10.1.2.3") || strings.Contains(string(resp.Data), "10.1.2.3") {
+		t.Errorf("address left in the answer: output %q, data %s", resp.Output, resp.Data)
+	}
+	if string(resp.Data) != `{"peers":{"[redacted]":{"state":"Established"}}}` {
+		t.Errorf("data = %s", resp.Data)
+	}
+
+	useRedaction(t, RedactionConfig{InternalPrefixes: []string{"203.0.113.0/24"}})
+	execute()
+
+	log, err := os.ReadFile(config.LogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(log)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("audit log = %q, want 2 lines", lines)
+	}
+	if !strings.HasSuffix(lines[0], "Router: bird1 - Command: show protocols - Success: true - Redacted: true") {
+		t.Errorf("first entry = %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], "Success: true - Redacted: false") {
+		t.Errorf("second entry = %q", lines[1])
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default ports of the RouterOS API service, plain and TLS (api-ssl)
+const (
+	defaultRouterOSPort    = 8728
+	defaultRouterOSTLSPort = 8729
+)
+
+// RouterOSError is a !trap or !fatal reply of the RouterOS API.
+type RouterOSError struct {
+	Message string
+}
+
+func (e *RouterOSError) Error() string {
+	return "RouterOS error: " + e.Message
+}
+
+type routerOSConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialRouterOS connects to the API service and logs in.
+func dialRouterOS(conn ConnectionConfig, timeout time.Duration) (*routerOSConn, error) {
+	port := conn.Port
+	if port == 0 {
+		port = defaultRouterOSPort
+		if conn.TLS {
+			port = defaultRouterOSTLSPort
+		}
+	}
+	addr := net.JoinHostPort(conn.Host, strconv.Itoa(port))
+
+	dialer := &net.Dialer{Timeout: timeout}
+	var c net.Conn
+	var err error
+	if conn.TLS {
+		var tlsConfig *tls.Config
+		if tlsConfig, err = tlsConfigFor(conn); err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName = conn.Host
+		c, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		c, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("RouterOS API connection failed: %v", err)
+	}
+
+	r := &routerOSConn{conn: c, reader: bufio.NewReader(c)}
+	c.SetDeadline(time.Now().Add(timeout))
+	err = r.run([]string{"/login", "=name=" + conn.Username, "=password=" + conn.Password}, nil)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("RouterOS login failed: %v", err)
+	}
+	c.SetDeadline(time.Time{})
+	return r, nil
+}
+
+func (r *routerOSConn) Close() error {
+	return r.conn.Close()
+}
+
+// writeWord writes one API word with its variable length prefix.
+func (r *routerOSConn) writeWord(w *bufio.Writer, word string) {
+	n := uint32(len(word))
+	var prefix []byte
+	switch {
+	case n < 0x80:
+		prefix = []byte{byte(n)}
+	case n < 0x4000:
+		prefix = binary.BigEndian.AppendUint16(nil, uint16(n)|0x8000)
+	case n < 0x200000:
+		prefix = binary.BigEndian.AppendUint32(nil, n|0xC00000)[1:]
+	case n < 0x10000000:
+		prefix = binary.BigEndian.AppendUint32(nil, n|0xE0000000)
+	default:
+		prefix = binary.BigEndian.AppendUint32([]byte{0xF0}, n)
+	}
+	w.Write(prefix)
+	w.WriteString(word)
+}
+
+func (r *routerOSConn) readWord() (string, error) {
+	first, err := r.reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+
+	var n uint32
+	var extra int
+	switch {
+	case first&0x80 == 0:
+		n = uint32(first)
+	case first&0xC0 == 0x80:
+		n, extra = uint32(first&0x3F), 1
+	case first&0xE0 == 0xC0:
+		n, extra = uint32(first&0x1F), 2
+	case first&0xF0 == 0xE0:
+		n, extra = uint32(first&0x0F), 3
+	default:
+		extra = 4
+	}
+	for i := 0; i < extra; i++ {
+		b, err := r.reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		n = n<<8 | uint32(b)
+	}
+
+	word := make([]byte, n)
+	if _, err := io.ReadFull(r.reader, word); err != nil {
+		return "", err
+	}
+	return string(word), nil
+}
+
+// run sends a sentence and calls handle with the attributes of each !re
+// reply, and their names in the order received, until !done.
+func (r *routerOSConn) run(sentence []string, handle func(attrs map[string]string, keys []string)) error {
+	w := bufio.NewWriter(r.conn)
+	for _, word := range sentence {
+		r.writeWord(w, word)
+	}
+	r.writeWord(w, "")
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("RouterOS API write failed: %v", err)
+	}
+
+	var trap error
+	for {
+		var reply string
+		var keys []string
+		attrs := map[string]string{}
+		for {
+			word, err := r.readWord()
+			if err != nil {
+				return fmt.Errorf("RouterOS API read failed: %w", err)
+			}
+			if word == "" {
+				break
+			}
+			if reply == "" {
+				reply = word
+				continue
+			}
+			// Attribute words look like "=name=value"
+			if key, value, ok := strings.Cut(strings.TrimPrefix(word, "="), "="); ok {
+				attrs[key] = value
+				keys = append(keys, key)
+			}
+		}
+
+		switch reply {
+		case "!re":
+			if handle != nil {
+				handle(attrs, keys)
+			}
+		case "!trap":
+			// The reply still ends with !done
+			trap = &RouterOSError{Message: attrs["message"]}
+		case "!fatal":
+			return &RouterOSError{Message: attrs["message"]}
+		case "!done":
+			return trap
+		}
+	}
+}
+
+// routerOSSentence turns a command template into an API sentence: the first
+// word is the command path, "?..." words are queries and any other word is
+// an attribute written as name=value.
+func routerOSSentence(command string) ([]string, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		return nil, fmt.Errorf("unsupported RouterOS command %q", command)
+	}
+
+	sentence := []string{fields[0]}
+	for _, field := range fields[1:] {
+		if strings.HasPrefix(field, "?") {
+			sentence = append(sentence, field)
+		} else {
+			sentence = append(sentence, "="+field)
+		}
+	}
+	return sentence, nil
+}
+
+// routerOSRouteQuery expands "?dst-address=<address>" into every prefix
+// covering the address, so the longest match can be picked from the
+// answer like the CLI route lookup does.
+func routerOSRouteQuery(sentence []string) ([]string, bool) {
+	for i, word := range sentence {
+		value, ok := strings.CutPrefix(word, "?dst-address=")
+		if !ok || strings.Contains(value, "/") {
+			continue
+		}
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return sentence, false
+		}
+
+		expanded := append([]string{}, sentence[:i]...)
+		for bits := addr.BitLen(); bits >= 0; bits-- {
+			prefix, _ := addr.Prefix(bits)
+			expanded = append(expanded, "?dst-address="+prefix.String())
+		}
+		// Combine all the prefix queries with OR
+		expanded = append(expanded, "?#"+strings.Repeat("|", addr.BitLen()))
+		return append(expanded, sentence[i+1:]...), true
+	}
+	return sentence, false
+}
+
+// runRouterOSCommand is the commandRunner for connection type "routeros"
+// (MikroTik RouterOS API). Every !re reply is emitted as text, print
+// commands as "name: value" blocks and the others (ping, traceroute) as one
+// line each, and returned as a list of attribute maps.
+func runRouterOSCommand(router RouterConfig, command string, timeout time.Duration, emit func(line string)) (any, error) {
+	sentence, err := routerOSSentence(command)
+	if err != nil {
+		return nil, err
+	}
+	sentence, longestMatch := routerOSRouteQuery(sentence)
+
+	r, err := dialRouterOS(router.Connection, connectTimeout(router.Connection))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	r.conn.SetDeadline(time.Now().Add(timeout))
+
+	isPrint := strings.HasSuffix(sentence[0], "/print")
+	replies := []map[string]string{}
+	order := map[string]int{}
+	err = r.run(sentence, func(attrs map[string]string, keys []string) {
+		replies = append(replies, attrs)
+		for _, key := range keys {
+			if _, ok := order[key]; !ok {
+				order[key] = len(order)
+			}
+		}
+		if !isPrint {
+			emit(formatRouterOSLine(attrs, keys))
+		}
+	})
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, fmt.Errorf("command timeout after %s", timeout)
+		}
+		return nil, err
+	}
+	if !isPrint {
+		return replies, nil
+	}
+
+	if longestMatch {
+		replies = longestRouterOSPrefix(replies)
+	}
+	if len(replies) == 0 {
+		emit("No entries found")
+	}
+	for i, attrs := range replies {
+		if i > 0 {
+			emit("")
+		}
+		for _, key := range orderedKeys(attrs, order) {
+			if !strings.HasPrefix(key, ".") {
+				emit(fmt.Sprintf("%s: %s", key, attrs[key]))
+			}
+		}
+	}
+	return replies, nil
+}
+
+// longestRouterOSPrefix keeps the routes of the most specific dst-address.
+func longestRouterOSPrefix(routes []map[string]string) []map[string]string {
+	best := -1
+	for _, route := range routes {
+		if prefix, err := netip.ParsePrefix(route["dst-address"]); err == nil && prefix.Bits() > best {
+			best = prefix.Bits()
+		}
+	}
+
+	out := []map[string]string{}
+	for _, route := range routes {
+		if prefix, err := netip.ParsePrefix(route["dst-address"]); err == nil && prefix.Bits() == best {
+			out = append(out, route)
+		}
+	}
+	return out
+}
+
+// formatRouterOSLine prints a reply as name=value pairs, internal
+// attributes such as .section left out.
+func formatRouterOSLine(attrs map[string]string, keys []string) string {
+	var parts []string
+	for _, key := range keys {
+		if !strings.HasPrefix(key, ".") {
+			parts = append(parts, key+"="+attrs[key])
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// orderedKeys returns the attribute names in the order the router first
+// sent them.
+func orderedKeys(attrs map[string]string, order map[string]int) []string {
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return order[keys[i]] < order[keys[j]] })
+	return keys
+}
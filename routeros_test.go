@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouterOSWordLength(t *testing.T) {
+	tests := []struct {
+		length int
+		prefix []byte
+	}{
+		{0, []byte{0x00}},
+		{0x7F, []byte{0x7F}},
+		{0x80, []byte{0x80, 0x80}},
+		{0x3FFF, []byte{0xBF, 0xFF}},
+		{0x4000, []byte{0xC0, 0x40, 0x00}},
+		{0x1FFFFF, []byte{0xDF, 0xFF, 0xFF}},
+		{0x200000, []byte{0xE0, 0x20, 0x00, 0x00}},
+	}
+
+	r := &routerOSConn{}
+	for _, tt := range tests {
+		word := strings.Repeat("a", tt.length)
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		r.writeWord(w, word)
+		w.Flush()
+
+		if got := buf.Bytes()[:len(tt.prefix)]; !bytes.Equal(got, tt.prefix) || buf.Len() != len(tt.prefix)+tt.length {
+			t.Errorf("length %#x: prefix % x, %d bytes, want % x", tt.length, got, buf.Len(), tt.prefix)
+			continue
+		}
+
+		r.reader = bufio.NewReader(&buf)
+		got, err := r.readWord()
+		if err != nil {
+			t.Errorf("length %#x: %v", tt.length, err)
+		} else if len(got) != tt.length {
+			t.Errorf("length %#x: read %d bytes back", tt.length, len(got))
+		}
+	}
+
+	// A word cut short is an error, not a shorter word
+	r.reader = bufio.NewReader(bytes.NewReader([]byte{0x80, 0x80, 'a'}))
+	if _, err := r.readWord(); err == nil {
+		t.Error("truncated word: want an error")
+	}
+}
+
+// serveRouterOS answers every sentence read from conn with the sentences
+// returned by answer.
+func serveRouterOS(conn net.Conn, answer func(sentence []string) [][]string) {
+	defer conn.Close()
+	r := &routerOSConn{conn: conn, reader: bufio.NewReader(conn)}
+	for {
+		var sentence []string
+		for {
+			word, err := r.readWord()
+			if err != nil {
+				return
+			}
+			if word == "" {
+				break
+			}
+			sentence = append(sentence, word)
+		}
+
+		w := bufio.NewWriter(conn)
+		for _, reply := range answer(sentence) {
+			for _, word := range reply {
+				r.writeWord(w, word)
+			}
+			r.writeWord(w, "")
+		}
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// pipeRouterOS returns a client session talking to answer over net.Pipe.
+func pipeRouterOS(t *testing.T, answer func(sentence []string) [][]string) *routerOSConn {
+	t.Helper()
+	client, server := net.Pipe()
+	go serveRouterOS(server, answer)
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	return &routerOSConn{conn: client, reader: bufio.NewReader(client)}
+}
+
+func TestRouterOSReplies(t *testing.T) {
+	tests := []struct {
+		name    string
+		replies [][]string
+		rows    []map[string]string
+		err     string
+	}{
+		{
+			name: "rows until done",
+			replies: [][]string{
+				{"!re", "=.id=*1", "=name=peer1"},
+				{"!re", "=.id=*2", "=name=peer2", "=comment=a=b"},
+				{"!done"},
+			},
+			rows: []map[string]string{
+				{".id": "*1", "name": "peer1"},
+				{".id": "*2", "name": "peer2", "comment": "a=b"},
+			},
+		},
+		{
+			// The error is reported once the reply ends with !done, after
+			// the rows before it
+			name: "trap",
+			replies: [][]string{
+				{"!re", "=name=peer1"},
+				{"!trap", "=category=0", "=message=no such item"},
+				{"!done"},
+			},
+			rows: []map[string]string{{"name": "peer1"}},
+			err:  "RouterOS error: no such item",
+		},
+		{
+			name:    "fatal",
+			replies: [][]string{{"!fatal", "=message=session terminated on request"}},
+			err:     "RouterOS error: session terminated on request",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent []string
+			r := pipeRouterOS(t, func(sentence []string) [][]string {
+				sent = sentence
+				return tt.replies
+			})
+
+			rows := []map[string]string(nil)
+			err := r.run([]string{"/routing/bgp/session/print", "?name=peer1"}, func(attrs map[string]string, keys []string) {
+				rows = append(rows, attrs)
+			})
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != "" {
+				var rosErr *RouterOSError
+				if !errors.As(err, &rosErr) || err.Error() != tt.err {
+					t.Fatalf("got %v, want %s", err, tt.err)
+				}
+			}
+			if !reflect.DeepEqual(rows, tt.rows) {
+				t.Errorf("rows = %v, want %v", rows, tt.rows)
+			}
+			if want := []string{"/routing/bgp/session/print", "?name=peer1"}; !reflect.DeepEqual(sent, want) {
+				t.Errorf("sentence = %q, want %q", sent, want)
+			}
+		})
+	}
+
+	// The session is still usable after a !trap
+	calls := 0
+	r := pipeRouterOS(t, func(sentence []string) [][]string {
+		calls++
+		if calls == 1 {
+			return [][]string{{"!trap", "=message=no such command"}, {"!done"}}
+		}
+		return [][]string{{"!re", "=name=ok"}, {"!done"}}
+	})
+	if err := r.run([]string{"/bogus"}, nil); err == nil {
+		t.Fatal("trap: want an error")
+	}
+	if err := r.run([]string{"/system/identity/print"}, nil); err != nil {
+		t.Fatalf("after trap: %v", err)
+	}
+}
+
+func TestRouterOSRouteQuery(t *testing.T) {
+	sentence, ok := routerOSRouteQuery([]string{"/ip/route/print", "?dst-address=192.0.2.1", "=detail="})
+	if !ok {
+		t.Fatal("address not expanded")
+	}
+	if len(sentence) != 1+33+1+1 || sentence[1] != "?dst-address=192.0.2.1/32" || sentence[33] != "?dst-address=0.0.0.0/0" {
+		t.Errorf("sentence = %q", sentence)
+	}
+	if or := sentence[34]; or != "?#"+strings.Repeat("|", 32) {
+		t.Errorf("or query = %q", or)
+	}
+	if sentence[35] != "=detail=" {
+		t.Errorf("trailing words lost: %q", sentence[35:])
+	}
+
+	for _, words := range [][]string{
+		{"/ip/route/print", "?dst-address=192.0.2.0/24"},
+		{"/routing/bgp/session/print"},
+	} {
+		if got, ok := routerOSRouteQuery(words); ok || !reflect.DeepEqual(got, words) {
+			t.Errorf("%q expanded to %q", words, got)
+		}
+	}
+}
+
+func TestLongestRouterOSPrefix(t *testing.T) {
+	routes := []map[string]string{
+		{"dst-address": "0.0.0.0/0", "gateway": "192.0.2.254"},
+		{"dst-address": "198.51.100.0/24", "gateway": "192.0.2.1"},
+		{"dst-address": "198.51.100.0/25", "gateway": "192.0.2.2"},
+		{"dst-address": "198.51.100.0/25", "gateway": "192.0.2.3"},
+		{"dst-address": "bogus"},
+	}
+	got := longestRouterOSPrefix(routes)
+	if len(got) != 2 || got[0]["gateway"] != "192.0.2.2" || got[1]["gateway"] != "192.0.2.3" {
+		t.Errorf("longest prefix routes = %v", got)
+	}
+	if got := longestRouterOSPrefix(nil); len(got) != 0 {
+		t.Errorf("no routes: %v", got)
+	}
+}
+
+func TestRouterOSRouteLookup(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	logins := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		serveRouterOS(conn, func(sentence []string) [][]string {
+			if sentence[0] == "/login" {
+				logins <- sentence
+				return [][]string{{"!done"}}
+			}
+			// Every route covering the address, the way the OR query
+			// answers it
+			return [][]string{
+				{"!re", "=.id=*1", "=dst-address=0.0.0.0/0", "=gateway=192.0.2.254"},
+				{"!re", "=.id=*2", "=dst-address=198.51.100.0/24", "=gateway=192.0.2.1"},
+				{"!done"},
+			}
+		})
+	}()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	router := RouterConfig{Name: "mikrotik1", OSType: "routeros", Connection: ConnectionConfig{
+		Type: "routeros", Host: host, Username: "lg", Password: "secret", Timeout: 2000,
+	}}
+	router.Connection.Port, _ = strconv.Atoi(port)
+
+	var lines []string
+	data, err := runRouterOSCommand(router, "/ip/route/print ?dst-address=198.51.100.7", 2*time.Second, func(line string) {
+		lines = append(lines, line)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login, want := <-logins, []string{"/login", "=name=lg", "=password=secret"}; !reflect.DeepEqual(login, want) {
+		t.Errorf("login = %q, want %q", login, want)
+	}
+	if want := []string{"dst-address: 198.51.100.0/24", "gateway: 192.0.2.1"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines = %q, want %q", lines, want)
+	}
+	if rows := data.([]map[string]string); len(rows) != 1 || rows[0][".id"] != "*2" {
+		t.Errorf("data = %v", data)
+	}
+}
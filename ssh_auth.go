@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Supported values for ConnectionConfig.AuthOrder
+const (
+	authPublicKey           = "publickey"
+	authAgent               = "agent"
+	authPassword            = "password"
+	authKeyboardInteractive = "keyboard-interactive"
+)
+
+// Used when authOrder is not configured: keys first, password last
+var defaultAuthOrder = []string{authPublicKey, authAgent, authPassword, authKeyboardInteractive}
+
+// sshAuthMethods builds the auth methods for a router in the configured order.
+// Methods without the settings they need are skipped. The returned cleanup
+// function closes the ssh-agent connection and must be called once the
+// handshake is over.
+func sshAuthMethods(conn ConnectionConfig) ([]ssh.AuthMethod, func(), error) {
+	order := conn.AuthOrder
+	if len(order) == 0 {
+		order = defaultAuthOrder
+	}
+
+	var methods []ssh.AuthMethod
+	var closers []func()
+	cleanup := func() {
+		for _, c := range closers {
+			c()
+		}
+	}
+
+	for _, name := range order {
+		switch strings.ToLower(name) {
+		case authPublicKey:
+			if conn.PrivateKeyFile == "" {
+				continue
+			}
+			signer, err := loadPrivateKey(conn.PrivateKeyFile, conn.Passphrase)
+			if err != nil {
+				cleanup()
+				return nil, nil, err
+			}
+			methods = append(methods, ssh.PublicKeys(signer))
+
+		case authAgent:
+			socket := conn.AgentSocket
+			if socket == "" {
+				socket = os.Getenv("SSH_AUTH_SOCK")
+			}
+			if socket == "" {
+				continue
+			}
+			agentConn, err := net.Dial("unix", socket)
+			if err != nil {
+				// A missing agent should not block the remaining methods
+				continue
+			}
+			closers = append(closers, func() { agentConn.Close() })
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+
+		case authPassword:
+			if conn.Password == "" {
+				continue
+			}
+			methods = append(methods, ssh.Password(conn.Password))
+
+		case authKeyboardInteractive:
+			if conn.Password == "" {
+				continue
+			}
+			methods = append(methods, ssh.KeyboardInteractive(passwordChallenge(conn.Password)))
+
+		default:
+			cleanup()
+			return nil, nil, fmt.Errorf("unknown SSH auth method %q", name)
+		}
+	}
+
+	if len(methods) == 0 {
+		cleanup()
+		return nil, nil, fmt.Errorf("no usable SSH auth method configured")
+	}
+	return methods, cleanup, nil
+}
+
+func loadPrivateKey(path, passphrase string) (ssh.Signer, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %v", err)
+	}
+
+	var signer ssh.Signer
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(pemBytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %s: %v", path, err)
+	}
+	return signer, nil
+}
+
+// passwordChallenge answers every keyboard-interactive prompt that does not
+// echo (i.e. password prompts) with the configured password.
+func passwordChallenge(password string) ssh.KeyboardInteractiveChallenge {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range questions {
+			if !echos[i] {
+				answers[i] = password
+			}
+		}
+		return answers, nil
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// authRecorder records the auth methods a client tries.
+type authRecorder struct {
+	mu    sync.Mutex
+	tried []string
+}
+
+func (a *authRecorder) record(method string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.tried = append(a.tried, method)
+}
+
+func (a *authRecorder) methods() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.tried...)
+}
+
+// serverConfig accepts the correct password or any key, but only with the
+// methods listed in accept.
+func (a *authRecorder) serverConfig(accept ...string) *ssh.ServerConfig {
+	result := func(method string) (*ssh.Permissions, error) {
+		a.record(method)
+		for _, m := range accept {
+			if m == method {
+				return nil, nil
+			}
+		}
+		return nil, errors.New("rejected")
+	}
+	return &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return result(authPublicKey)
+		},
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "secret" {
+				return nil, errors.New("wrong password")
+			}
+			return result(authPassword)
+		},
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := client("", "", []string{"Username: ", "Password: "}, []bool{true, false})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) != 2 || answers[0] != "" || answers[1] != "secret" {
+				return nil, errors.New("wrong answers")
+			}
+			return result(authKeyboardInteractive)
+		},
+	}
+}
+
+// writeTestKey saves a new ed25519 private key in OpenSSH format.
+func writeTestKey(t *testing.T) (string, ssh.Signer) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, signer
+}
+
+// startTestAgent serves an ssh-agent holding one key on a unix socket.
+func startTestAgent(t *testing.T) (string, ssh.PublicKey) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unix socket paths are short, t.TempDir() may be too long
+	dir, err := os.MkdirTemp("", "lg-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+
+	signer, _ := ssh.NewSignerFromKey(key)
+	return socket, signer.PublicKey()
+}
+
+func TestSSHAuthOrder(t *testing.T) {
+	keyFile, _ := writeTestKey(t)
+
+	tests := []struct {
+		name   string
+		order  []string
+		accept []string
+		tried  []string
+	}{
+		{"default order", nil, []string{authPassword}, []string{authPublicKey, authPassword}},
+		{"password first", []string{authPassword, authPublicKey}, []string{authPublicKey}, []string{authPassword, authPublicKey}},
+		{"keyboard-interactive first", []string{authKeyboardInteractive, authPassword}, []string{authPassword}, []string{authKeyboardInteractive, authPassword}},
+		{"first method accepted", []string{authKeyboardInteractive, authPublicKey}, []string{authKeyboardInteractive}, []string{authKeyboardInteractive}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &authRecorder{}
+			router, _ := serveTestSSH(t, recorder.serverConfig(tt.accept...))
+			router.Connection.Password = "secret"
+			router.Connection.PrivateKeyFile = keyFile
+			router.Connection.AgentSocket = "/nonexistent/agent.sock"
+			router.Connection.AuthOrder = tt.order
+
+			client, err := dialSSH(router)
+			if err != nil {
+				t.Fatalf("dialSSH failed: %v (tried %v)", err, recorder.methods())
+			}
+			client.Close()
+			if got := recorder.methods(); !reflect.DeepEqual(got, tt.tried) {
+				t.Errorf("methods tried = %v, want %v", got, tt.tried)
+			}
+		})
+	}
+}
+
+func TestSSHAuthAgent(t *testing.T) {
+	socket, agentKey := startTestAgent(t)
+
+	router, _ := serveTestSSH(t, &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), agentKey.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	})
+	router.Connection.AgentSocket = socket
+	router.Connection.AuthOrder = []string{authAgent}
+
+	client, err := dialSSH(router)
+	if err != nil {
+		t.Fatalf("agent authentication failed: %v", err)
+	}
+	client.Close()
+}
+
+func TestSSHAuthMethodsSkipUnusable(t *testing.T) {
+	// An agent socket nobody listens on is skipped
+	methods, cleanup, err := sshAuthMethods(ConnectionConfig{
+		AgentSocket: "/nonexistent/agent.sock",
+		Password:    "secret",
+		AuthOrder:   []string{authAgent, authPassword},
+	})
+	if err != nil {
+		t.Fatalf("unreachable agent blocked the password: %v", err)
+	}
+	cleanup()
+	if len(methods) != 1 {
+		t.Errorf("got %d methods, want only password", len(methods))
+	}
+
+	if _, _, err := sshAuthMethods(ConnectionConfig{AgentSocket: "/nonexistent/agent.sock", AuthOrder: []string{authAgent}}); err == nil {
+		t.Error("unreachable agent as the only method: want an error")
+	}
+	if _, _, err := sshAuthMethods(ConnectionConfig{Password: "secret", AuthOrder: []string{"hostbased"}}); err == nil {
+		t.Error("unknown method: want an error")
+	}
+}
+
+func TestPasswordChallenge(t *testing.T) {
+	answers, err := passwordChallenge("secret")("looking-glass", "", []string{"Username: ", "Password: ", "OTP: "}, []bool{true, false, false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"", "secret", "secret"}; !reflect.DeepEqual(answers, want) {
+		t.Errorf("answers = %q, want %q", answers, want)
+	}
+}
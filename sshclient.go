@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Names accepted in RouterConfig.SSHProfile
+const (
+	sshProfileModern = "modern"
+	sshProfileLegacy = "legacy"
+	sshProfileCustom = "custom"
+)
+
+type SSHAlgorithmsConfig struct {
+	KeyExchanges      []string `json:"keyExchanges"`
+	Ciphers           []string `json:"ciphers"`
+	MACs              []string `json:"macs"`
+	HostKeyAlgorithms []string `json:"hostKeyAlgorithms"`
+}
+
+// Algorithm profiles. "modern" only offers what current OpenSSH still enables
+// by default; "legacy" keeps the old list needed by older Huawei VRP images.
+var sshProfiles = map[string]SSHAlgorithmsConfig{
+	sshProfileModern: {
+		KeyExchanges: []string{
+			"curve25519-sha256",
+			"curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp256",
+			"ecdh-sha2-nistp384",
+			"ecdh-sha2-nistp521",
+			"diffie-hellman-group16-sha512",
+			"diffie-hellman-group14-sha256",
+		},
+		Ciphers: []string{
+			"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+			"chacha20-poly1305@openssh.com",
+			"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		},
+		MACs: []string{
+			"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+			"hmac-sha2-256", "hmac-sha2-512",
+		},
+	},
+	sshProfileLegacy: {
+		KeyExchanges: []string{
+			"diffie-hellman-group-exchange-sha256",
+			"diffie-hellman-group-exchange-sha1",
+			"diffie-hellman-group14-sha256",
+			"diffie-hellman-group14-sha1",
+			"diffie-hellman-group1-sha1",
+			"curve25519-sha256",
+			"curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp256",
+			"ecdh-sha2-nistp384",
+			"ecdh-sha2-nistp521",
+		},
+		Ciphers: []string{
+			"aes128-ctr", "aes192-ctr", "aes256-ctr",
+			"aes128-cbc", "aes192-cbc", "aes256-cbc",
+			"3des-cbc", "blowfish-cbc", "cast128-cbc",
+			"arcfour256", "arcfour128", "arcfour",
+		},
+		MACs: []string{
+			"hmac-sha2-256", "hmac-sha2-512", "hmac-sha1",
+			"hmac-sha1-96", "hmac-md5", "hmac-md5-96", "hmac-ripemd160",
+		},
+	},
+}
+
+// sshAlgorithms resolves the algorithm set of a router. An empty profile
+// means "modern"; "custom" uses the lists from sshAlgorithms in the config.
+func sshAlgorithms(router RouterConfig) (string, SSHAlgorithmsConfig, error) {
+	profile := router.SSHProfile
+	if profile == "" {
+		profile = sshProfileModern
+	}
+
+	if profile == sshProfileCustom {
+		algos := router.SSHAlgorithms
+		if len(algos.KeyExchanges) == 0 && len(algos.Ciphers) == 0 && len(algos.MACs) == 0 {
+			return "", SSHAlgorithmsConfig{}, fmt.Errorf("router %s uses the custom SSH profile but sshAlgorithms is empty", router.Name)
+		}
+		return profile, algos, nil
+	}
+
+	algos, ok := sshProfiles[profile]
+	if !ok {
+		return "", SSHAlgorithmsConfig{}, fmt.Errorf("router %s has unknown SSH profile %q", router.Name, profile)
+	}
+	return profile, algos, nil
+}
+
+// dialSSH opens an authenticated SSH connection to a router using its auth
+// methods, host key policy and algorithm profile.
+func dialSSH(router RouterConfig) (*ssh.Client, error) {
+	connConfig := router.Connection
+
+	profile, algos, err := sshAlgorithms(router)
+	if err != nil {
+		return nil, err
+	}
+
+	authMethods, closeAuth, err := sshAuthMethods(connConfig)
+	if err != nil {
+		return nil, fmt.Errorf("SSH auth setup failed: %v", err)
+	}
+	defer closeAuth()
+
+	addr := fmt.Sprintf("%s:%d", connConfig.Host, connConfig.Port)
+
+	// Ask for a key type known_hosts can verify, unless the profile decides
+	hostKeyAlgorithms := algos.HostKeyAlgorithms
+	if len(hostKeyAlgorithms) == 0 && len(router.HostKeyFingerprints) == 0 {
+		hostKeyAlgorithms = knownHostKeyAlgorithms(addr)
+	}
+
+	sshConfig := &ssh.ClientConfig{
+		User:              connConfig.Username,
+		Auth:              authMethods,
+		HostKeyCallback:   hostKeyCallback(router),
+		HostKeyAlgorithms: hostKeyAlgorithms,
+		Timeout:           connectTimeout(connConfig),
+		Config: ssh.Config{
+			KeyExchanges: algos.KeyExchanges,
+			Ciphers:      algos.Ciphers,
+			MACs:         algos.MACs,
+		},
+	}
+
+	var client *ssh.Client
+	if hop := connConfig.JumpHost; hop != nil {
+		log.Printf("Connecting to %s via %s with %s SSH algorithms...", addr, hop, profile)
+		client, err = dialSSHVia(*hop, addr, sshConfig)
+	} else {
+		log.Printf("Connecting to %s with %s SSH algorithms...", addr, profile)
+		client, err = ssh.Dial("tcp", addr, sshConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("SSH connected to %s: profile=%s server=%q %s",
+		addr, profile, client.ServerVersion(), negotiatedAlgorithms(client))
+	return client, nil
+}
+
+// negotiatedAlgorithms describes the algorithms picked in the handshake.
+// The MAC is empty for AEAD ciphers, which authenticate on their own.
+func negotiatedAlgorithms(client *ssh.Client) string {
+	conn, ok := client.Conn.(ssh.AlgorithmsConnMetadata)
+	if !ok {
+		return "algorithms=unknown"
+	}
+	algos := conn.Algorithms()
+
+	describe := func(dir ssh.DirectionAlgorithms) string {
+		mac := dir.MAC
+		if mac == "" {
+			mac = "implicit"
+		}
+		return dir.Cipher + " mac=" + mac
+	}
+	text := fmt.Sprintf("kex=%s hostkey=%s cipher=%s", algos.KeyExchange, algos.HostKey, describe(algos.Write))
+	if algos.Read != algos.Write {
+		text += " (server to client: " + describe(algos.Read) + ")"
+	}
+	return text
+}
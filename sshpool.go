@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Pool defaults, overridable via ConnectionConfig.PoolSize/MaxSessions and
+// the ssh section
+const (
+	defaultPoolSize    = 2
+	defaultMaxSessions = 4
+	defaultKeepalive   = 30 * time.Second
+	defaultIdleTimeout = 5 * time.Minute
+)
+
+// How long a connection refusing a new session gets to answer a keepalive
+// before it is taken for dead and closed under its other sessions
+const sessionFailureCheck = 5 * time.Second
+
+// sshConnPool keeps authenticated SSH connections to every router so that
+// requests only have to open a new session instead of a full handshake.
+var sshConnPool = &sshPool{routers: make(map[string]*routerPool)}
+
+type sshPool struct {
+	mu      sync.Mutex
+	routers map[string]*routerPool
+}
+
+type routerPool struct {
+	router  RouterConfig
+	mu      sync.Mutex
+	changed *sync.Cond // broadcast when a dial finishes or a session ends
+	conns   []*pooledConn
+	dialing int
+}
+
+type pooledConn struct {
+	client   *ssh.Client
+	sessions int
+	lastUsed time.Time
+	retired  bool // no new sessions, closed once the last one ends
+	closed   bool
+}
+
+// newSession returns a session on a pooled connection to the router, dialing
+// a new one when needed. The release function must be called once the
+// session is finished with; it also closes the session.
+func (p *sshPool) newSession(router RouterConfig) (*ssh.Session, func(), error) {
+	if router.Connection.PoolSize < 0 {
+		// Pooling disabled for this router
+		client, err := dialSSH(router)
+		if err != nil {
+			return nil, nil, err
+		}
+		session, err := client.NewSession()
+		if err != nil {
+			client.Close()
+			return nil, nil, err
+		}
+		return session, func() { session.Close(); client.Close() }, nil
+	}
+
+	rp := p.get(router)
+
+	// One retry: a pooled connection may have died since its last keepalive
+	for attempt := 0; ; attempt++ {
+		pc, err := rp.acquire()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		session, err := pc.client.NewSession()
+		if err == nil {
+			return session, func() {
+				session.Close()
+				rp.release(pc)
+			}, nil
+		}
+
+		// Other requests may still be running on the connection: the router
+		// may only be refusing more channels
+		log.Printf("SSH session on pooled connection to %s failed, retiring it: %v", router.Name, err)
+		rp.retire(pc)
+		if attempt > 0 {
+			return nil, nil, err
+		}
+	}
+}
+
+func (p *sshPool) get(router RouterConfig) *routerPool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rp, ok := p.routers[router.Name]
+	if !ok {
+		rp = &routerPool{router: router}
+		rp.changed = sync.NewCond(&rp.mu)
+		p.routers[router.Name] = rp
+		go rp.maintain()
+	}
+	return rp
+}
+
+// closeAll shuts down every pooled connection, used on server shutdown.
+func (p *sshPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, rp := range p.routers {
+		rp.mu.Lock()
+		for _, pc := range rp.conns {
+			pc.closed = true
+			pc.client.Close()
+		}
+		rp.conns = nil
+		rp.mu.Unlock()
+	}
+}
+
+func (rp *routerPool) size() int {
+	if rp.router.Connection.PoolSize > 0 {
+		return rp.router.Connection.PoolSize
+	}
+	return defaultPoolSize
+}
+
+func (rp *routerPool) maxSessions() int {
+	if rp.router.Connection.MaxSessions > 0 {
+		return rp.router.Connection.MaxSessions
+	}
+	return defaultMaxSessions
+}
+
+// acquire picks an idle connection, dials a new one while the pool is below
+// its size, or shares the least busy connection once the pool is full. When
+// the pool is full of connections still being dialed or already running
+// maxSessions sessions, it waits, so no more than size connections are ever
+// opened to the router. Retired connections are neither used nor counted.
+func (rp *routerPool) acquire() (*pooledConn, error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	for {
+		var best *pooledConn
+		active := 0
+		for _, pc := range rp.conns {
+			if pc.retired {
+				continue
+			}
+			active++
+			if pc.sessions < rp.maxSessions() && (best == nil || pc.sessions < best.sessions) {
+				best = pc
+			}
+		}
+
+		full := active+rp.dialing >= rp.size()
+		if best != nil && (best.sessions == 0 || full) {
+			best.sessions++
+			best.lastUsed = time.Now()
+			return best, nil
+		}
+		if !full {
+			break
+		}
+		rp.changed.Wait()
+	}
+
+	// No connection yet, or all of them busy and there is room to grow
+	rp.dialing++
+	rp.mu.Unlock()
+
+	client, err := dialSSH(rp.router)
+
+	rp.mu.Lock()
+	rp.dialing--
+	rp.changed.Broadcast()
+	if err != nil {
+		return nil, err
+	}
+
+	pc := &pooledConn{client: client, sessions: 1, lastUsed: time.Now()}
+	rp.conns = append(rp.conns, pc)
+	go rp.watch(pc)
+	return pc, nil
+}
+
+func (rp *routerPool) release(pc *pooledConn) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	pc.sessions--
+	pc.lastUsed = time.Now()
+	if pc.retired && pc.sessions == 0 {
+		rp.removeLocked(pc)
+	}
+	rp.changed.Broadcast()
+}
+
+// retire gives up the session a failed NewSession was counted for and stops
+// new sessions on the connection. It is closed once its other sessions end,
+// or at once if it does not answer a keepalive.
+func (rp *routerPool) retire(pc *pooledConn) {
+	rp.mu.Lock()
+	pc.retired = true
+	rp.mu.Unlock()
+	rp.release(pc)
+
+	go func() {
+		rp.mu.Lock()
+		closed := pc.closed
+		rp.mu.Unlock()
+		if closed {
+			return
+		}
+		if err := keepalive(pc.client, sessionFailureCheck); err != nil {
+			log.Printf("Retired SSH connection to %s is dead: %v", rp.router.Name, err)
+			rp.discard(pc)
+		}
+	}()
+}
+
+// discard removes a broken connection from the pool and closes it.
+func (rp *routerPool) discard(pc *pooledConn) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	rp.removeLocked(pc)
+}
+
+func (rp *routerPool) removeLocked(pc *pooledConn) {
+	for i, c := range rp.conns {
+		if c == pc {
+			rp.conns = append(rp.conns[:i], rp.conns[i+1:]...)
+			rp.changed.Broadcast()
+			break
+		}
+	}
+	if !pc.closed {
+		pc.closed = true
+		pc.client.Close()
+	}
+}
+
+// watch drops a connection from the pool as soon as the router closes it.
+func (rp *routerPool) watch(pc *pooledConn) {
+	err := pc.client.Wait()
+
+	rp.mu.Lock()
+	closed := pc.closed
+	rp.mu.Unlock()
+
+	if !closed {
+		log.Printf("Pooled SSH connection to %s closed by peer: %v", rp.router.Name, err)
+	}
+	rp.discard(pc)
+}
+
+// maintain sends keepalives on every pooled connection and closes the ones
+// that have been idle for too long.
+func (rp *routerPool) maintain() {
+	interval := defaultKeepalive
+	if config.SSH.KeepaliveMs > 0 {
+		interval = time.Duration(config.SSH.KeepaliveMs) * time.Millisecond
+	}
+	idleTimeout := defaultIdleTimeout
+	if config.SSH.IdleTimeoutMs > 0 {
+		idleTimeout = time.Duration(config.SSH.IdleTimeoutMs) * time.Millisecond
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rp.mu.Lock()
+		conns := append([]*pooledConn(nil), rp.conns...)
+		rp.mu.Unlock()
+
+		for _, pc := range conns {
+			rp.mu.Lock()
+			idle := pc.sessions == 0 && time.Since(pc.lastUsed) > idleTimeout
+			if idle {
+				rp.removeLocked(pc)
+			}
+			rp.mu.Unlock()
+
+			if idle {
+				log.Printf("Closed idle SSH connection to %s", rp.router.Name)
+				continue
+			}
+
+			if err := keepalive(pc.client, interval); err != nil {
+				log.Printf("SSH keepalive to %s failed: %v", rp.router.Name, err)
+				rp.discard(pc)
+			}
+		}
+	}
+}
+
+// keepalive checks that the router still answers on the connection, closing
+// it when no reply arrives within timeout.
+func keepalive(client *ssh.Client, timeout time.Duration) error {
+	timer := time.AfterFunc(timeout, func() { client.Close() })
+	_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+	if !timer.Stop() && err != nil {
+		err = fmt.Errorf("no reply within %s", timeout)
+	}
+	return err
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// serveTestSSH runs an SSH server with serverConfig and a new ed25519 host
+// key, and returns a router pinned to that key. Sessions are accepted and
+// closed straight away.
+func serveTestSSH(t *testing.T, serverConfig *ssh.ServerConfig) (RouterConfig, ssh.Signer) {
+	t.Helper()
+	return serveTestSSHWith(t, serverConfig, func(chans <-chan ssh.NewChannel) {
+		for newChannel := range chans {
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(requests)
+			channel.Close()
+		}
+	})
+}
+
+// serveTestSSHWith is serveTestSSH with handle serving the channels of
+// every connection.
+func serveTestSSHWith(t *testing.T, serverConfig *ssh.ServerConfig, handle func(chans <-chan ssh.NewChannel)) (RouterConfig, ssh.Signer) {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				handle(chans)
+			}()
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	router := RouterConfig{
+		Name:                t.Name(),
+		HostKeyFingerprints: []string{ssh.FingerprintSHA256(signer.PublicKey())},
+		Connection: ConnectionConfig{
+			Host:     host,
+			Username: "looking-glass",
+		},
+	}
+	router.Connection.Port, _ = strconv.Atoi(port)
+	return router, signer
+}
+
+// startTestSSHServer runs an SSH server accepting password "secret" and
+// counting the connections it authenticates.
+func startTestSSHServer(t *testing.T) (RouterConfig, *atomic.Int32) {
+	t.Helper()
+
+	var logins atomic.Int32
+	router, _ := serveTestSSH(t, &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "secret" {
+				return nil, errors.New("wrong password")
+			}
+			// Slow logins make concurrent requests overlap with the dial
+			time.Sleep(50 * time.Millisecond)
+			logins.Add(1)
+			return nil, nil
+		},
+	})
+	router.Connection.Password = "secret"
+	return router, &logins
+}
+
+func TestSSHPoolBoundsConcurrentDials(t *testing.T) {
+	router, logins := startTestSSHServer(t)
+	router.Connection.PoolSize = 2
+
+	pool := &sshPool{routers: make(map[string]*routerPool)}
+	defer pool.closeAll()
+
+	const requests = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session, release, err := pool.newSession(router)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer release()
+			_ = session
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("newSession failed: %v", err)
+	}
+	if n := logins.Load(); n > 2 {
+		t.Errorf("%d concurrent requests opened %d connections, want at most 2", requests, n)
+	}
+}
+
+// startChannelLimitedSSH runs an SSH server like startTestSSHServer that
+// keeps sessions open until the client closes them and refuses more than
+// limit of them per connection, like OpenSSH MaxSessions. It counts the
+// connections that have been closed.
+func startChannelLimitedSSH(t *testing.T, limit int) (RouterConfig, *atomic.Int32, *atomic.Int32) {
+	t.Helper()
+
+	var logins, closed atomic.Int32
+	router, _ := serveTestSSHWith(t, &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			logins.Add(1)
+			return nil, nil
+		},
+	}, func(chans <-chan ssh.NewChannel) {
+		var mu sync.Mutex
+		open := 0
+		for newChannel := range chans {
+			mu.Lock()
+			if open >= limit {
+				mu.Unlock()
+				newChannel.Reject(ssh.ResourceShortage, "too many sessions")
+				continue
+			}
+			open++
+			mu.Unlock()
+
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(requests)
+			go func() {
+				io.Copy(io.Discard, channel)
+				channel.Close()
+				mu.Lock()
+				open--
+				mu.Unlock()
+			}()
+		}
+		closed.Add(1)
+	})
+	router.Connection.Password = "secret"
+	return router, &logins, &closed
+}
+
+func TestSSHPoolRetiresRefusingConnection(t *testing.T) {
+	router, logins, closed := startChannelLimitedSSH(t, 2)
+	router.Connection.PoolSize = 1
+	router.Connection.MaxSessions = 10
+
+	pool := &sshPool{routers: make(map[string]*routerPool)}
+	defer pool.closeAll()
+
+	var releases []func()
+	for i := 0; i < 3; i++ {
+		_, release, err := pool.newSession(router)
+		if err != nil {
+			t.Fatalf("session %d: %v", i+1, err)
+		}
+		releases = append(releases, release)
+	}
+	// The third session needed a second connection, the first one must
+	// still be open for the two sessions running on it
+	if n := logins.Load(); n != 2 {
+		t.Errorf("%d connections dialed, want 2", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := closed.Load(); n != 0 {
+		t.Fatalf("%d connections closed under running sessions", n)
+	}
+
+	// Once they end, the retired connection goes away
+	releases[0]()
+	releases[1]()
+	deadline := time.Now().Add(2 * time.Second)
+	for closed.Load() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("retired connection not closed after its last session")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	releases[2]()
+
+	// New sessions use the remaining connection
+	_, release, err := pool.newSession(router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if n := logins.Load(); n != 2 {
+		t.Errorf("%d connections dialed, want 2", n)
+	}
+}
+
+func TestSSHPoolMaxSessions(t *testing.T) {
+	router, logins, _ := startChannelLimitedSSH(t, 10)
+	router.Connection.PoolSize = 1
+	router.Connection.MaxSessions = 2
+
+	pool := &sshPool{routers: make(map[string]*routerPool)}
+	defer pool.closeAll()
+
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		_, release, err := pool.newSession(router)
+		if err != nil {
+			t.Fatal(err)
+		}
+		releases = append(releases, release)
+	}
+
+	// A third request waits for a session to end instead of opening a
+	// channel the router may refuse
+	done := make(chan error, 1)
+	go func() {
+		_, release, err := pool.newSession(router)
+		if err == nil {
+			release()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("third session did not wait: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	releases[0]()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("third session still waiting after a release")
+	}
+	releases[1]()
+
+	if n := logins.Load(); n != 1 {
+		t.Errorf("%d connections dialed, want 1", n)
+	}
+}
+
+func TestKeepaliveTimeout(t *testing.T) {
+	router, _ := startTestSSHServer(t)
+
+	// Proxy that silently drops everything the client sends once frozen,
+	// like a half-dead TCP connection
+	var frozen atomic.Bool
+	target := net.JoinHostPort(router.Connection.Host, strconv.Itoa(router.Connection.Port))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		upstream, err := net.Dial("tcp", target)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		go io.Copy(conn, upstream)
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				upstream.Close()
+				return
+			}
+			if !frozen.Load() {
+				upstream.Write(buf[:n])
+			}
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	router.Connection.Port, _ = strconv.Atoi(port)
+
+	client, err := dialSSH(router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := keepalive(client, time.Second); err != nil {
+		t.Fatalf("keepalive on a live connection failed: %v", err)
+	}
+
+	frozen.Store(true)
+	start := time.Now()
+	if err := keepalive(client, 200*time.Millisecond); err == nil {
+		t.Fatal("keepalive on a dead connection succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("keepalive returned after %s, want about 200ms", elapsed)
+	}
+}
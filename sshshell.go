@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Terminal size requested for interactive sessions; wide enough that the
+// router does not wrap long output lines
+const (
+	shellTermWidth  = 512
+	shellTermHeight = 0
+)
+
+// runSSHShellCommand is used instead of an exec channel for ShellOnly OSes
+// and routers with execMode "shell". It opens an interactive session, waits
+// for the prompt, disables paging and types the command, emitting the output
+// up to the next prompt without prompts and echoed input.
+func runSSHShellCommand(router RouterConfig, command string, timeout time.Duration, emit func(line string)) (any, error) {
+	session, release, err := sshConnPool.newSession(router)
+	if err != nil {
+		return nil, errors.New(sshErrorMessage(err))
+	}
+	defer release()
+	defer session.Close()
+
+	modes := ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_ISPEED: 38400, ssh.TTY_OP_OSPEED: 38400}
+	if err := session.RequestPty("vt100", shellTermHeight, shellTermWidth, modes); err != nil {
+		return nil, fmt.Errorf("PTY request failed: %v", err)
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("stdin pipe failed: %v", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("stdout pipe failed: %v", err)
+	}
+	if err := session.Shell(); err != nil {
+		return nil, fmt.Errorf("shell request failed: %v", err)
+	}
+
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(timeout, func() {
+		timedOut.Store(true)
+		session.Close()
+	})
+	defer timer.Stop()
+
+	prompt := routerPrompt(router)
+	if prompt == nil {
+		prompt = defaultCLIPrompt
+	}
+
+	// The login banner comes before the first prompt
+	s := &cliSession{w: stdin, r: stdout, newline: "\n"}
+	defer s.close()
+	_, err = s.expect(nil, prompt)
+	if err == nil {
+		err = s.run(router, command, emit)
+	}
+
+	if timedOut.Load() {
+		return nil, fmt.Errorf("command timeout after %s", timeout)
+	}
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("shell session closed by the router")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("shell session failed: %v", err)
+	}
+	return nil, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// newStreamSender prepares w for newline-delimited JSON streaming and returns
+// a function that writes and flushes a single event. The returned function
+// is safe to call from several goroutines (stdout and stderr readers).
+func newStreamSender(w http.ResponseWriter) (func(StreamResponse), bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
+	}
+
+	// Set headers per streaming
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	var mu sync.Mutex
+	return func(resp StreamResponse) {
+		data, _ := json.Marshal(resp)
+
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, "%s\n", data)
+		flusher.Flush()
+	}, true
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const defaultTelnetPort = 23
+
+// Telnet protocol bytes (RFC 854) and the options the client agrees to
+const (
+	telnetIAC  = 255
+	telnetDONT = 254
+	telnetDO   = 253
+	telnetWONT = 252
+	telnetWILL = 251
+	telnetSB   = 250
+	telnetSE   = 240
+
+	telnetOptEcho = 1
+	telnetOptSGA  = 3
+)
+
+// Login prompts, matched against the unterminated last line the router sent
+var (
+	telnetUsernamePrompt = regexp.MustCompile(`(?i)(login|user\s*name|user)\s*:\s*$`)
+	telnetPasswordPrompt = regexp.MustCompile(`(?i)pass(word|code)\s*:\s*$`)
+	telnetLoginFailed    = regexp.MustCompile(`(?i)(login incorrect|authentication failed|access denied|bad password)`)
+)
+
+// telnetReader strips option negotiation and other commands from the data
+// stream, refusing every option except echo and suppress-go-ahead.
+type telnetReader struct {
+	conn  net.Conn
+	state int
+	verb  byte
+}
+
+// States of the telnetReader command parser
+const (
+	telnetStateData = iota
+	telnetStateIAC
+	telnetStateOption
+	telnetStateSub
+	telnetStateSubIAC
+)
+
+func (t *telnetReader) Read(p []byte) (int, error) {
+	for {
+		n, err := t.conn.Read(p)
+		out := 0
+		for _, b := range p[:n] {
+			switch t.state {
+			case telnetStateData:
+				if b == telnetIAC {
+					t.state = telnetStateIAC
+				} else if b != 0 {
+					p[out] = b
+					out++
+				}
+			case telnetStateIAC:
+				switch b {
+				case telnetIAC:
+					p[out] = b
+					out++
+					t.state = telnetStateData
+				case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+					t.verb = b
+					t.state = telnetStateOption
+				case telnetSB:
+					t.state = telnetStateSub
+				default:
+					t.state = telnetStateData
+				}
+			case telnetStateOption:
+				t.reply(t.verb, b)
+				t.state = telnetStateData
+			case telnetStateSub:
+				if b == telnetIAC {
+					t.state = telnetStateSubIAC
+				}
+			case telnetStateSubIAC:
+				if b == telnetSE {
+					t.state = telnetStateData
+				} else {
+					t.state = telnetStateSub
+				}
+			}
+		}
+		if out > 0 || err != nil {
+			return out, err
+		}
+	}
+}
+
+// reply answers an option request. WONT and DONT need no answer.
+func (t *telnetReader) reply(verb, option byte) {
+	switch verb {
+	case telnetWILL:
+		answer := byte(telnetDONT)
+		if option == telnetOptEcho || option == telnetOptSGA {
+			answer = telnetDO
+		}
+		t.conn.Write([]byte{telnetIAC, answer, option})
+	case telnetDO:
+		answer := byte(telnetWONT)
+		if option == telnetOptSGA {
+			answer = telnetWILL
+		}
+		t.conn.Write([]byte{telnetIAC, answer, option})
+	}
+}
+
+// telnetLogin answers the username and password prompts until the CLI
+// prompt.
+func telnetLogin(s *cliSession, conn ConnectionConfig, prompt *regexp.Regexp) error {
+	var failed bool
+	onLine := func(line string) {
+		if telnetLoginFailed.MatchString(line) {
+			failed = true
+		}
+	}
+
+	sentUsername, sentPassword := false, false
+	for {
+		match, err := s.expect(onLine, prompt, telnetUsernamePrompt, telnetPasswordPrompt)
+		if err != nil {
+			return err
+		}
+		switch match {
+		case 0:
+			return nil
+		case 1:
+			if sentUsername || failed {
+				return errors.New("telnet login failed")
+			}
+			sentUsername = true
+			err = s.send(conn.Username)
+		case 2:
+			if sentPassword || failed {
+				return errors.New("telnet login failed")
+			}
+			sentPassword = true
+			err = s.send(conn.Password)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// runTelnetCommand is the commandRunner for connection type "telnet", for
+// legacy routers without SSH. It logs in, disables paging and types the
+// command, emitting its output without prompts and echoed input.
+func runTelnetCommand(router RouterConfig, command string, timeout time.Duration, emit func(line string)) (any, error) {
+	connConfig := router.Connection
+	prompt := routerPrompt(router)
+	if prompt == nil {
+		prompt = defaultCLIPrompt
+	}
+
+	port := connConfig.Port
+	if port == 0 {
+		port = defaultTelnetPort
+	}
+	addr := net.JoinHostPort(connConfig.Host, strconv.Itoa(port))
+
+	conn, err := net.DialTimeout("tcp", addr, connectTimeout(connConfig))
+	if err != nil {
+		return nil, fmt.Errorf("telnet connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	s := &cliSession{w: conn, r: &telnetReader{conn: conn}, newline: "\r\n"}
+	defer s.close()
+
+	conn.SetDeadline(time.Now().Add(connectTimeout(connConfig)))
+	if err := telnetLogin(s, connConfig, prompt); err != nil {
+		return nil, telnetError(err, "telnet login timeout")
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := s.run(router, command, emit); err != nil {
+		return nil, telnetError(err, fmt.Sprintf("command timeout after %s", timeout))
+	}
+	return nil, nil
+}
+
+// telnetError replaces deadline errors with the given timeout message.
+func telnetError(err error, timeoutMessage string) error {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return errors.New(timeoutMessage)
+	case errors.Is(err, io.EOF):
+		return errors.New("telnet connection closed by the router")
+	case errors.As(err, &netErr):
+		return fmt.Errorf("telnet session failed: %v", err)
+	}
+	return err
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTelnetReader(t *testing.T) {
+	const (
+		optTType = 24
+		nop      = 241
+	)
+	iac := func(b ...byte) string { return string(append([]byte{telnetIAC}, b...)) }
+
+	tests := []struct {
+		name    string
+		chunks  []string // written one after the other by the router
+		data    string
+		replies string
+	}{
+		{"plain data", []string{"<R1>\r\n"}, "<R1>\r\n", ""},
+		{"escaped 0xFF", []string{"a" + iac(telnetIAC) + "b"}, "a\xffb", ""},
+		{"NUL dropped", []string{"a\x00b"}, "ab", ""},
+		{"other commands dropped", []string{"a" + iac(nop) + "b"}, "ab", ""},
+		{
+			"WILL",
+			[]string{iac(telnetWILL, telnetOptEcho) + iac(telnetWILL, telnetOptSGA) + iac(telnetWILL, optTType) + "x"},
+			"x",
+			iac(telnetDO, telnetOptEcho) + iac(telnetDO, telnetOptSGA) + iac(telnetDONT, optTType),
+		},
+		{
+			"DO",
+			[]string{iac(telnetDO, telnetOptSGA) + iac(telnetDO, telnetOptEcho) + iac(telnetDO, optTType) + "x"},
+			"x",
+			iac(telnetWILL, telnetOptSGA) + iac(telnetWONT, telnetOptEcho) + iac(telnetWONT, optTType),
+		},
+		{"WONT and DONT unanswered", []string{iac(telnetWONT, telnetOptEcho) + iac(telnetDONT, telnetOptSGA) + "x"}, "x", ""},
+		{
+			"subnegotiation",
+			[]string{"a" + iac(telnetSB, optTType, 1) + iac(telnetSE) + "b"},
+			"ab",
+			"",
+		},
+		{
+			// An escaped 0xFF or a bare SE inside the subnegotiation does
+			// not end it
+			"subnegotiation with IAC inside",
+			[]string{"a" + iac(telnetSB, optTType, 0) + iac(telnetIAC) + string([]byte{telnetSE}) + "xterm" + iac(telnetSE) + "b"},
+			"ab",
+			"",
+		},
+		{
+			"split across reads",
+			[]string{"a", iac(), string([]byte{telnetWILL}), string([]byte{telnetOptSGA}), iac(), string([]byte{telnetIAC}), "b"},
+			"a\xffb",
+			iac(telnetDO, telnetOptSGA),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			client.SetDeadline(time.Now().Add(2 * time.Second))
+
+			// Everything the client answers, until it hangs up
+			replies := make(chan string, 1)
+			go func() {
+				var buf bytes.Buffer
+				io.Copy(&buf, server)
+				replies <- buf.String()
+			}()
+			go func() {
+				for _, chunk := range append(tt.chunks, "END") {
+					server.Write([]byte(chunk))
+				}
+			}()
+
+			r := &telnetReader{conn: client}
+			var data []byte
+			buf := make([]byte, 64)
+			for !bytes.HasSuffix(data, []byte("END")) {
+				n, err := r.Read(buf)
+				if err != nil {
+					t.Fatalf("read failed after %q: %v", data, err)
+				}
+				if n == 0 {
+					t.Fatal("empty read")
+				}
+				data = append(data, buf[:n]...)
+			}
+			client.Close()
+
+			if got := strings.TrimSuffix(string(data), "END"); got != tt.data {
+				t.Errorf("data = %q, want %q", got, tt.data)
+			}
+			if got := <-replies; got != tt.replies {
+				t.Errorf("replies = % x, want % x", got, tt.replies)
+			}
+		})
+	}
+}
+
+// telnetLoginScript plays a router login over net.Pipe: it writes each
+// step and reads one line of answer before the next, then hangs up when
+// hangUp is set. It returns the lines the client sent.
+func telnetLoginScript(conn net.Conn, steps []string, hangUp bool) <-chan []string {
+	sent := make(chan []string, 1)
+	go func() {
+		var lines []string
+		defer func() { sent <- lines }()
+		r := bufio.NewReader(conn)
+		for i, step := range steps {
+			if _, err := io.WriteString(conn, step); err != nil {
+				return
+			}
+			if i == len(steps)-1 {
+				break
+			}
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines = append(lines, strings.TrimRight(line, "\r\n"))
+		}
+		if hangUp {
+			conn.Close()
+			return
+		}
+		io.Copy(io.Discard, r)
+	}()
+	return sent
+}
+
+func TestTelnetLogin(t *testing.T) {
+	tests := []struct {
+		name   string
+		steps  []string
+		hangUp bool
+		sent   []string
+		err    string
+	}{
+		{
+			name:  "logged in",
+			steps: []string{"\r\nUser Access Verification\r\n\r\nUsername: ", "Password: ", "\r\nInfo: The max number of VTY users is 5.\r\n<R1>"},
+			sent:  []string{"lg", "secret"},
+		},
+		{
+			name:  "password only",
+			steps: []string{"\r\nPassword: ", "\r\n<R1>"},
+			sent:  []string{"secret"},
+		},
+		{
+			name:  "login incorrect",
+			steps: []string{"Username: ", "Password: ", "\r\nLogin incorrect\r\n\r\nUsername: "},
+			sent:  []string{"lg", "secret"},
+			err:   "telnet login failed",
+		},
+		{
+			// Some routers ask again without saying why
+			name:  "password asked again",
+			steps: []string{"Username: ", "Password: ", "\r\nPassword: "},
+			sent:  []string{"lg", "secret"},
+			err:   "telnet login failed",
+		},
+		{
+			name:   "closed by the router",
+			steps:  []string{"Username: ", "Password: ", "\r\n% Authentication failed\r\n"},
+			hangUp: true,
+			sent:   []string{"lg", "secret"},
+			err:    "telnet connection closed by the router",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			sent := telnetLoginScript(server, tt.steps, tt.hangUp)
+
+			s := &cliSession{w: client, r: &telnetReader{conn: client}, newline: "\r\n"}
+			err := telnetLogin(s, ConnectionConfig{Username: "lg", Password: "secret"}, routerPrompt(RouterConfig{OSType: "huawei"}))
+			if err != nil {
+				err = telnetError(err, "telnet login timeout")
+			}
+			client.Close()
+			s.close()
+
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != "" && (err == nil || err.Error() != tt.err) {
+				t.Fatalf("got %v, want %s", err, tt.err)
+			}
+			if got := <-sent; !reflect.DeepEqual(got, tt.sent) {
+				t.Errorf("sent %q, want %q", got, tt.sent)
+			}
+		})
+	}
+}
+
+func TestTelnetErrorTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(50 * time.Millisecond))
+
+	// The router never prompts
+	s := &cliSession{w: client, r: &telnetReader{conn: client}, newline: "\r\n"}
+	defer s.close()
+	err := telnetLogin(s, ConnectionConfig{Username: "lg", Password: "secret"}, defaultCLIPrompt)
+	if err = telnetError(err, "telnet login timeout"); err == nil || err.Error() != "telnet login timeout" {
+		t.Errorf("got %v, want the login timeout", err)
+	}
+	if err := telnetError(errors.New("other"), "timeout"); err.Error() != "other" {
+		t.Errorf("other errors changed: %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// ValidationError is returned when an ExecuteRequest cannot be safely turned
+// into a router command. Handlers answer it with 400 Bad Request.
+type ValidationError struct {
+	Field  string
+	Code   string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Reason)
+}
+
+// Argument kinds accepted by the different query types
+const (
+	argNone     = "none"
+	argAddress  = "address"  // bare IP address
+	argPrefix   = "prefix"   // IP address or CIDR prefix
+	argHostname = "hostname" // IP address or DNS hostname
+)
+
+// RFC 1123 labels: letters, digits and inner hyphens, at most 63 characters
+var hostnameLabelRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// validateExecuteRequest checks protocol, query and address of the request and
+// replaces req.Addr with its canonical form. Nothing that comes out of here
+// can contain whitespace, pipes or other CLI metacharacters.
+func validateExecuteRequest(req *ExecuteRequest) error {
+	if req.Protocol != "IPv4" && req.Protocol != "IPv6" {
+		return &ValidationError{Field: "protocol", Code: "invalid_protocol", Reason: "must be IPv4 or IPv6"}
+	}
+
+	def, ok := findQuery(req.Query)
+	if !ok {
+		return &ValidationError{Field: "query", Code: "invalid_query", Reason: "unknown query type"}
+	}
+	argType := def.Argument
+	if !def.AddressRequired {
+		argType = argNone
+	}
+
+	addr, err := canonicalizeArgument(argType, req.Protocol, req.Addr)
+	if err != nil {
+		return err
+	}
+	req.Addr = addr
+	return nil
+}
+
+// canonicalizeArgument validates addr against the given argument kind and
+// address family and returns the string that is safe to put on a router CLI.
+func canonicalizeArgument(argType, protocol, addr string) (string, error) {
+	if argType == argNone {
+		// Not interpolated into the command, so just drop whatever was sent
+		return "", nil
+	}
+
+	addr = strings.TrimSpace(addr)
+	if addr == "" {
+		return "", &ValidationError{Field: "addr", Code: "missing_address", Reason: "address is required for this query type"}
+	}
+	if len(addr) > 253 {
+		return "", &ValidationError{Field: "addr", Code: "invalid_address", Reason: "address is too long"}
+	}
+
+	if strings.Contains(addr, "/") {
+		if argType != argPrefix {
+			return "", &ValidationError{Field: "addr", Code: "invalid_address", Reason: "a prefix is not allowed for this query type"}
+		}
+		prefix, err := netip.ParsePrefix(addr)
+		if err != nil {
+			return "", &ValidationError{Field: "addr", Code: "invalid_address", Reason: "not a valid IP prefix"}
+		}
+		if err := checkFamily(prefix.Addr(), protocol); err != nil {
+			return "", err
+		}
+		return prefix.Masked().String(), nil
+	}
+
+	if ip, err := netip.ParseAddr(addr); err == nil {
+		if ip.Zone() != "" {
+			return "", &ValidationError{Field: "addr", Code: "invalid_address", Reason: "scoped addresses are not allowed"}
+		}
+		if err := checkFamily(ip, protocol); err != nil {
+			return "", err
+		}
+		return ip.String(), nil
+	}
+
+	if argType != argHostname {
+		return "", &ValidationError{Field: "addr", Code: "invalid_address", Reason: "not a valid IP address"}
+	}
+	return canonicalizeHostname(addr)
+}
+
+func checkFamily(ip netip.Addr, protocol string) error {
+	if ip.Is4In6() {
+		return &ValidationError{Field: "addr", Code: "invalid_address", Reason: "IPv4-mapped IPv6 addresses are not allowed"}
+	}
+	if protocol == "IPv6" && !ip.Is6() {
+		return &ValidationError{Field: "addr", Code: "family_mismatch", Reason: "IPv4 address given for an IPv6 query"}
+	}
+	if protocol == "IPv4" && !ip.Is4() {
+		return &ValidationError{Field: "addr", Code: "family_mismatch", Reason: "IPv6 address given for an IPv4 query"}
+	}
+	return nil
+}
+
+// canonicalizeHostname accepts only fully qualified RFC 1123 hostnames and
+// returns them lower-cased without the trailing dot.
+func canonicalizeHostname(name string) (string, error) {
+	invalid := &ValidationError{Field: "addr", Code: "invalid_hostname", Reason: "not a valid IP address or hostname"}
+
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return "", invalid
+	}
+	for _, label := range labels {
+		if !hostnameLabelRegex.MatchString(label) {
+			return "", invalid
+		}
+	}
+	// An all-numeric TLD means a mangled IPv4 address, not a hostname
+	if strings.Trim(labels[len(labels)-1], "0123456789") == "" {
+		return "", invalid
+	}
+	return name, nil
+}
+
+// newErrorResponse builds the JSON error body, carrying the validation code
+// when there is one.
+func newErrorResponse(err error) ErrorResponse {
+	resp := ErrorResponse{Error: err.Error()}
+	if verr, ok := err.(*ValidationError); ok {
+		resp.Code = verr.Code
+	}
+	return resp
+}
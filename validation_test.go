@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalizeArgumentRejects(t *testing.T) {
+	longLabel := strings.Repeat("a", 64)
+
+	tests := []struct {
+		name     string
+		argType  string
+		protocol string
+		addr     string
+		code     string
+	}{
+		{"empty", argPrefix, "IPv4", "  ", "missing_address"},
+		{"semicolon", argHostname, "IPv4", "8.8.8.8;reboot", "invalid_hostname"},
+		{"semicolon in prefix", argPrefix, "IPv4", "8.8.8.0/24;reboot", "invalid_address"},
+		{"pipe", argHostname, "IPv4", "8.8.8.8 | include secret", "invalid_hostname"},
+		{"command substitution", argHostname, "IPv4", "$(reboot).example.com", "invalid_hostname"},
+		{"backticks", argHostname, "IPv4", "`reboot`.example.com", "invalid_hostname"},
+		{"inner newline", argHostname, "IPv4", "8.8.8.8\nreload", "invalid_hostname"},
+		{"inner carriage return", argAddress, "IPv4", "8.8.8.8\rreload", "invalid_address"},
+		{"space", argPrefix, "IPv4", "8.8.8.8 detail", "invalid_address"},
+		{"IPv6 zone", argAddress, "IPv6", "fe80::1%eth0", "invalid_address"},
+		{"IPv6 zone as hostname", argHostname, "IPv6", "fe80::1%eth0", "invalid_address"},
+		{"IPv4 prefix too long", argPrefix, "IPv4", "10.0.0.0/33", "invalid_address"},
+		{"IPv6 prefix too long", argPrefix, "IPv6", "2001:db8::/129", "invalid_address"},
+		{"negative prefix length", argPrefix, "IPv4", "10.0.0.0/-1", "invalid_address"},
+		{"missing prefix length", argPrefix, "IPv4", "10.0.0.0/", "invalid_address"},
+		{"prefix not allowed", argAddress, "IPv4", "10.0.0.0/8", "invalid_address"},
+		{"prefix for hostname query", argHostname, "IPv4", "10.0.0.0/8", "invalid_address"},
+		{"IPv4 for IPv6 query", argAddress, "IPv6", "192.0.2.1", "family_mismatch"},
+		{"IPv6 for IPv4 query", argPrefix, "IPv4", "2001:db8::1", "family_mismatch"},
+		{"IPv6 prefix for IPv4 query", argPrefix, "IPv4", "2001:db8::/32", "family_mismatch"},
+		{"IPv4-mapped IPv6", argAddress, "IPv6", "::ffff:192.0.2.1", "invalid_address"},
+		{"hostname for address query", argAddress, "IPv4", "example.com", "invalid_address"},
+		{"numeric TLD", argHostname, "IPv4", "host.123", "invalid_hostname"},
+		{"mangled IPv4", argHostname, "IPv4", "8.8.8.256", "invalid_hostname"},
+		{"single label", argHostname, "IPv4", "localhost", "invalid_hostname"},
+		{"label too long", argHostname, "IPv4", longLabel + ".example.com", "invalid_hostname"},
+		{"leading hyphen", argHostname, "IPv4", "-rf.example.com", "invalid_hostname"},
+		{"empty label", argHostname, "IPv4", "a..example.com", "invalid_hostname"},
+		{"underscore", argHostname, "IPv4", "a_b.example.com", "invalid_hostname"},
+		{"name too long", argHostname, "IPv4", strings.Repeat("a.", 127) + "com", "invalid_address"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := canonicalizeArgument(tt.argType, tt.protocol, tt.addr)
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("canonicalizeArgument(%q) = %q, %v; want a ValidationError", tt.addr, got, err)
+			}
+			if verr.Code != tt.code {
+				t.Errorf("canonicalizeArgument(%q) code = %s, want %s", tt.addr, verr.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestCanonicalizeArgumentCanonicalForm(t *testing.T) {
+	tests := []struct {
+		name     string
+		argType  string
+		protocol string
+		addr     string
+		want     string
+	}{
+		{"IPv4 address", argAddress, "IPv4", "192.0.2.1", "192.0.2.1"},
+		{"surrounding whitespace", argAddress, "IPv4", " 192.0.2.1\n", "192.0.2.1"},
+		{"IPv6 compressed", argAddress, "IPv6", "2001:DB8:0:0:0:0:0:1", "2001:db8::1"},
+		{"IPv4 prefix masked", argPrefix, "IPv4", "192.168.1.77/24", "192.168.1.0/24"},
+		{"IPv6 prefix masked", argPrefix, "IPv6", "2001:DB8:1:2::5/32", "2001:db8::/32"},
+		{"host route", argPrefix, "IPv4", "192.0.2.1/32", "192.0.2.1/32"},
+		{"address for prefix query", argPrefix, "IPv6", "2001:db8::0001", "2001:db8::1"},
+		{"hostname lower-cased", argHostname, "IPv4", "WWW.Example.COM", "www.example.com"},
+		{"hostname trailing dot", argHostname, "IPv6", "example.com.", "example.com"},
+		{"hostname with digits and hyphens", argHostname, "IPv4", "as-12345.r1.example.net", "as-12345.r1.example.net"},
+		{"address for hostname query", argHostname, "IPv4", "8.8.8.8", "8.8.8.8"},
+		{"no argument", argNone, "IPv4", "8.8.8.8; reload", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := canonicalizeArgument(tt.argType, tt.protocol, tt.addr)
+			if err != nil {
+				t.Fatalf("canonicalizeArgument(%q) failed: %v", tt.addr, err)
+			}
+			if got != tt.want {
+				t.Errorf("canonicalizeArgument(%q) = %q, want %q", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateExecuteRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		req  ExecuteRequest
+		want string // canonical Addr, or the expected error code
+		err  bool
+	}{
+		{"bgp prefix", ExecuteRequest{Query: "bgp", Protocol: "IPv4", Addr: "10.1.2.3/8"}, "10.0.0.0/8", false},
+		{"ping hostname", ExecuteRequest{Query: "ping", Protocol: "IPv6", Addr: "Example.ORG"}, "example.org", false},
+		{"summary drops addr", ExecuteRequest{Query: "summary", Protocol: "IPv4", Addr: "; reload"}, "", false},
+		{"unknown protocol", ExecuteRequest{Query: "bgp", Protocol: "IPX", Addr: "10.0.0.1"}, "invalid_protocol", true},
+		{"unknown query", ExecuteRequest{Query: "show running-config", Protocol: "IPv4"}, "invalid_query", true},
+		{"prefix for neighbor", ExecuteRequest{Query: "advertised-routes", Protocol: "IPv4", Addr: "10.0.0.0/8"}, "invalid_address", true},
+		{"injection in ping", ExecuteRequest{Query: "ping", Protocol: "IPv4", Addr: "8.8.8.8 | reload"}, "invalid_hostname", true},
+		{"missing address", ExecuteRequest{Query: "trace", Protocol: "IPv4"}, "missing_address", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			err := validateExecuteRequest(&req)
+			if tt.err {
+				var verr *ValidationError
+				if !errors.As(err, &verr) {
+					t.Fatalf("got %v, want a ValidationError", err)
+				}
+				if verr.Code != tt.want {
+					t.Errorf("code = %s, want %s", verr.Code, tt.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateExecuteRequest failed: %v", err)
+			}
+			if req.Addr != tt.want {
+				t.Errorf("Addr = %q, want %q", req.Addr, tt.want)
+			}
+		})
+	}
+}